@@ -1085,8 +1085,8 @@ func (c *Client) Exec(name string, cmd []string, env map[string]string, stdin *o
 	return opMd.GetInt("return")
 }
 
-func (c *Client) Action(name string, action shared.ContainerAction, timeout int, force bool) (*Response, error) {
-	body := shared.Jmap{"action": action, "timeout": timeout, "force": force}
+func (c *Client) Action(name string, action shared.ContainerAction, timeout int, force bool, stateful bool) (*Response, error) {
+	body := shared.Jmap{"action": action, "timeout": timeout, "force": force, "stateful": stateful}
 	return c.put(fmt.Sprintf("containers/%s/state", name), body, Async)
 }
 
@@ -1117,6 +1117,46 @@ func (c *Client) ContainerStatus(name string) (*shared.ContainerState, error) {
 	return &ct, nil
 }
 
+// ContainerState returns the state of a container, along with its resource
+// usage if it's running.
+func (c *Client) ContainerState(name string) (*shared.ContainerStatus, error) {
+	st := shared.ContainerStatus{}
+
+	resp, err := c.get(fmt.Sprintf("containers/%s/state", name))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp.Metadata, &st); err != nil {
+		return nil, err
+	}
+
+	return &st, nil
+}
+
+func (c *Client) ContainerProcesses(name string) ([]shared.ContainerProcess, error) {
+	processes := []shared.ContainerProcess{}
+
+	resp, err := c.get(fmt.Sprintf("containers/%s/processes", name))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp.Metadata, &processes); err != nil {
+		return nil, err
+	}
+
+	return processes, nil
+}
+
+// SignalProcess sends a signal to the process with the pid (in the
+// container's namespace) in a container.
+func (c *Client) SignalProcess(name string, pid int, signal int) error {
+	body := shared.Jmap{"pid": pid, "signal": signal}
+	_, err := c.post(fmt.Sprintf("containers/%s/processes", name), body, Sync)
+	return err
+}
+
 func (c *Client) ProfileConfig(name string) (*shared.ProfileConfig, error) {
 	ct := shared.ProfileConfig{}
 
@@ -1132,7 +1172,7 @@ func (c *Client) ProfileConfig(name string) (*shared.ProfileConfig, error) {
 	return &ct, nil
 }
 
-func (c *Client) PushFile(container string, p string, gid int, uid int, mode os.FileMode, buf io.ReadSeeker) error {
+func (c *Client) pushFile(container string, p string, ftype string, gid int, uid int, mode os.FileMode, buf io.Reader) error {
 	query := url.Values{"path": []string{p}}
 	uri := c.url(shared.APIVersion, "containers", container, "files") + "?" + query.Encode()
 
@@ -1142,6 +1182,7 @@ func (c *Client) PushFile(container string, p string, gid int, uid int, mode os.
 	}
 	req.Header.Set("User-Agent", shared.UserAgent)
 
+	req.Header.Set("X-LXD-type", ftype)
 	req.Header.Set("X-LXD-mode", fmt.Sprintf("%04o", mode))
 	req.Header.Set("X-LXD-uid", strconv.FormatUint(uint64(uid), 10))
 	req.Header.Set("X-LXD-gid", strconv.FormatUint(uint64(gid), 10))
@@ -1155,21 +1196,114 @@ func (c *Client) PushFile(container string, p string, gid int, uid int, mode os.
 	return err
 }
 
-func (c *Client) PullFile(container string, p string) (int, int, os.FileMode, io.ReadCloser, error) {
+func (c *Client) PushFile(container string, p string, gid int, uid int, mode os.FileMode, buf io.ReadSeeker) error {
+	return c.pushFile(container, p, "file", gid, uid, mode, buf)
+}
+
+// MkdirFile creates a directory in a container, or changes the owner and
+// mode of an existing one.
+func (c *Client) MkdirFile(container string, p string, gid int, uid int, mode os.FileMode) error {
+	return c.pushFile(container, p, "directory", gid, uid, mode, nil)
+}
+
+// PushSymlink creates a symlink to target in a container.
+func (c *Client) PushSymlink(container string, p string, target string, gid int, uid int) error {
+	return c.pushFile(container, p, "symlink", gid, uid, 0777, strings.NewReader(target))
+}
+
+// PullFile returns the owner, mode and type ("file", "directory" or
+// "symlink") of a file in a container. For regular files, the body is the
+// file's content; for the others, it's a sync response, see
+// ParseFileMetadata.
+func (c *Client) PullFile(container string, p string) (int, int, os.FileMode, string, io.ReadCloser, error) {
 	uri := c.url(shared.APIVersion, "containers", container, "files")
 	query := url.Values{"path": []string{p}}
 
 	r, err := c.getRaw(uri + "?" + query.Encode())
 	if err != nil {
-		return 0, 0, 0, nil, err
+		return 0, 0, 0, "", nil, err
 	}
 
 	uid, gid, mode, err := shared.ParseLXDFileHeaders(r.Header)
 	if err != nil {
-		return 0, 0, 0, nil, err
+		r.Body.Close()
+		return 0, 0, 0, "", nil, err
+	}
+
+	ftype := r.Header.Get("X-LXD-type")
+	if ftype == "" {
+		ftype = "file"
+	}
+
+	return uid, gid, mode, ftype, r.Body, nil
+}
+
+// ParseFileMetadata decodes the body PullFile returns for a directory, into
+// a []shared.ContainerFileEntry, or for a symlink, into a string.
+func ParseFileMetadata(body io.Reader, v interface{}) error {
+	resp := Response{}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return err
 	}
 
-	return uid, gid, mode, r.Body, nil
+	return json.Unmarshal(resp.Metadata, v)
+}
+
+// ListDirectory lists the entries of a directory in a container.
+func (c *Client) ListDirectory(container string, p string) ([]shared.ContainerFileEntry, error) {
+	uri := c.url(shared.APIVersion, "containers", container, "files")
+	query := url.Values{"path": []string{p}}
+
+	resp, err := c.baseGet(uri + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []shared.ContainerFileEntry{}
+	if err := json.Unmarshal(resp.Metadata, &entries); err != nil {
+		return nil, fmt.Errorf(gettext.Gettext("%s is not a directory"), p)
+	}
+
+	return entries, nil
+}
+
+// ReadSymlink returns the target of a symlink in a container.
+func (c *Client) ReadSymlink(container string, p string) (string, error) {
+	uri := c.url(shared.APIVersion, "containers", container, "files")
+	query := url.Values{"path": []string{p}}
+
+	resp, err := c.baseGet(uri + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+
+	var target string
+	if err := json.Unmarshal(resp.Metadata, &target); err != nil {
+		return "", fmt.Errorf(gettext.Gettext("%s is not a symlink"), p)
+	}
+
+	return target, nil
+}
+
+// DeleteFile removes a file, a symlink or an empty directory from a
+// container.
+func (c *Client) DeleteFile(container string, p string) error {
+	query := url.Values{"path": []string{p}}
+	uri := c.url(shared.APIVersion, "containers", container, "files") + "?" + query.Encode()
+
+	req, err := http.NewRequest("DELETE", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", shared.UserAgent)
+
+	raw, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = HoistResponse(raw, Sync)
+	return err
 }
 
 func (c *Client) SetRemotePwd(password string) (*Response, error) {
@@ -1177,8 +1311,10 @@ func (c *Client) SetRemotePwd(password string) (*Response, error) {
 	return c.put("", body, Sync)
 }
 
-func (c *Client) MigrateTo(container string) (*Response, error) {
-	body := shared.Jmap{"migration": true}
+// MigrateTo sets up the source end of a migration. The container's
+// snapshots are sent along, unless containerOnly is set.
+func (c *Client) MigrateTo(container string, containerOnly bool) (*Response, error) {
+	body := shared.Jmap{"migration": true, "container_only": containerOnly}
 	return c.post(fmt.Sprintf("containers/%s", container), body, Async)
 }
 
@@ -1199,11 +1335,50 @@ func (c *Client) MigrateFrom(name string, operation string, secrets map[string]s
 	return c.post("containers", body, Async)
 }
 
+// MigratePush has the container pushed to a sink created with
+// MigrateReceive, for when the sink can't connect to the source.
+func (c *Client) MigratePush(container string, operation string, secrets map[string]string, containerOnly bool) (*Response, error) {
+	body := shared.Jmap{
+		"migration":      true,
+		"container_only": containerOnly,
+		"target": shared.Jmap{
+			"operation": operation,
+			"secrets":   secrets,
+		},
+	}
+	return c.post(fmt.Sprintf("containers/%s", container), body, Async)
+}
+
+// MigrateReceive sets up a sink in push mode, waiting for the source to
+// connect to it. The response's metadata holds the secrets to give the
+// source.
+func (c *Client) MigrateReceive(name string, live bool, config map[string]string, profiles []string) (*Response, error) {
+	source := shared.Jmap{
+		"type": "migration",
+		"mode": "push",
+		"live": live,
+	}
+	body := shared.Jmap{
+		"source":   source,
+		"name":     name,
+		"config":   config,
+		"profiles": profiles,
+	}
+
+	return c.post("containers", body, Async)
+}
+
 func (c *Client) Rename(name string, newName string) (*Response, error) {
 	body := shared.Jmap{"name": newName}
 	return c.post(fmt.Sprintf("containers/%s", name), body, Async)
 }
 
+// CancelOperation cancels an operation, given as in Response.Operation.
+func (c *Client) CancelOperation(operation string) error {
+	_, err := c.delete(path.Join("operations", path.Base(operation)), nil, Sync)
+	return err
+}
+
 /* Wait for an operation */
 func (c *Client) WaitFor(waitURL string) (*shared.Operation, error) {
 	if len(waitURL) < 1 {
@@ -1224,6 +1399,21 @@ func (c *Client) WaitFor(waitURL string) (*shared.Operation, error) {
 	return resp.MetadataAsOperation()
 }
 
+// WaitForTimeout is WaitFor, giving up after timeout seconds. The
+// operation may then still be running.
+func (c *Client) WaitForTimeout(waitURL string, timeout int) (*shared.Operation, error) {
+	if len(waitURL) < 1 {
+		return nil, fmt.Errorf(gettext.Gettext("invalid wait url %s"), waitURL)
+	}
+
+	resp, err := c.baseGet(c.url(waitURL, "wait") + fmt.Sprintf("?timeout=%d", timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.MetadataAsOperation()
+}
+
 func (c *Client) WaitForSuccess(waitURL string) error {
 	op, err := c.WaitFor(waitURL)
 	if err != nil {
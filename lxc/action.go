@@ -10,8 +10,9 @@ import (
 )
 
 type actionCmd struct {
-	action     shared.ContainerAction
-	hasTimeout bool
+	action      shared.ContainerAction
+	hasTimeout  bool
+	hasStateful bool
 }
 
 func (c *actionCmd) showByDefault() bool {
@@ -20,6 +21,7 @@ func (c *actionCmd) showByDefault() bool {
 
 var timeout = -1
 var force = false
+var stateful = false
 
 func (c *actionCmd) usage() string {
 	return fmt.Sprintf(gettext.Gettext(
@@ -33,6 +35,10 @@ func (c *actionCmd) flags() {
 		gnuflag.IntVar(&timeout, "timeout", -1, gettext.Gettext("Time to wait for the container before killing it."))
 		gnuflag.BoolVar(&force, "force", false, gettext.Gettext("Force the container to shutdown."))
 	}
+
+	if c.hasStateful {
+		gnuflag.BoolVar(&stateful, "stateful", false, gettext.Gettext("Store the container's running state when stopping it, restore it when starting it."))
+	}
 }
 
 func (c *actionCmd) run(config *lxd.Config, args []string) error {
@@ -46,7 +52,7 @@ func (c *actionCmd) run(config *lxd.Config, args []string) error {
 		return err
 	}
 
-	resp, err := d.Action(name, c.action, timeout, force)
+	resp, err := d.Action(name, c.action, timeout, force, stateful)
 	if err != nil {
 		return err
 	}
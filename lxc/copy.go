@@ -3,17 +3,22 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/gosexy/gettext"
 	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
 	"github.com/lxc/lxd/shared"
+	"golang.org/x/crypto/ssh/terminal"
 	"gopkg.in/lxc/go-lxc.v2"
 )
 
 type copyCmd struct {
-	httpAddr string
+	httpAddr      string
+	containerOnly bool
 }
 
 func (c *copyCmd) showByDefault() bool {
@@ -24,12 +29,16 @@ func (c *copyCmd) usage() string {
 	return gettext.Gettext(
 		"Copy containers within or in between lxd instances.\n" +
 			"\n" +
-			"lxc copy <source container> <destination container>\n")
+			"lxc copy [--container-only] <source container> <destination container>\n" +
+			"\n" +
+			"Between lxd instances, the container's snapshots are copied along, unless --container-only is passed.\n")
 }
 
-func (c *copyCmd) flags() {}
+func (c *copyCmd) flags() {
+	gnuflag.BoolVar(&c.containerOnly, "container-only", false, gettext.Gettext("Copy the container without its snapshots"))
+}
 
-func copyContainer(config *lxd.Config, sourceResource string, destResource string, keepVolatile bool) error {
+func copyContainer(config *lxd.Config, sourceResource string, destResource string, keepVolatile bool, containerOnly bool) error {
 	sourceRemote, sourceName := config.ParseRemoteAndContainer(sourceResource)
 	destRemote, destName := config.ParseRemoteAndContainer(destResource)
 
@@ -46,9 +55,9 @@ func copyContainer(config *lxd.Config, sourceResource string, destResource strin
 		return err
 	}
 
-	status := shared.ContainerState{}
+	status := &shared.ContainerState{}
 	if !shared.IsSnapshot(sourceName) {
-		status, err := source.ContainerStatus(sourceName)
+		status, err = source.ContainerStatus(sourceName)
 		if err != nil {
 			return err
 		}
@@ -98,26 +107,19 @@ func copyContainer(config *lxd.Config, sourceResource string, destResource strin
 			return fmt.Errorf(gettext.Gettext("not all the profiles from the source exist on the target"))
 		}
 
-		to, err := source.MigrateTo(sourceName)
-		if err != nil {
-			return err
+		/*
+		 * Have the target pull the container if it can reach the source,
+		 * otherwise (e.g. if the source is behind NAT) have the source
+		 * push it to the target.
+		 */
+		reachable, err := migratePull(source, dest, sourceName, status, containerOnly)
+		if !reachable {
+			err = migratePush(source, dest, sourceName, status, containerOnly)
 		}
-
-		secrets := map[string]string{}
-		if err := json.Unmarshal(to.Metadata, &secrets); err != nil {
-			return err
-		}
-
-		url := source.BaseWSURL + path.Join(to.Operation, "websocket")
-		migration, err := dest.MigrateFrom(sourceName, url, secrets, status.Config, status.Profiles)
 		if err != nil {
 			return err
 		}
 
-		if err := dest.WaitForSuccess(migration.Operation); err != nil {
-			return err
-		}
-
 		if sourceName != destName {
 			rename, err := dest.Rename(sourceName, destName)
 			if err != nil {
@@ -130,10 +132,151 @@ func copyContainer(config *lxd.Config, sourceResource string, destResource strin
 	}
 }
 
+/*
+ * migratePull migrates a container with the target connecting to the
+ * source. It returns false if the target couldn't reach the source, in which
+ * case nothing was done (and the source's operation is cancelled).
+ */
+func migratePull(source *lxd.Client, dest *lxd.Client, name string, status *shared.ContainerState, containerOnly bool) (bool, error) {
+	to, err := source.MigrateTo(name, containerOnly)
+	if err != nil {
+		return true, err
+	}
+
+	secrets := map[string]string{}
+	if err := json.Unmarshal(to.Metadata, &secrets); err != nil {
+		return true, err
+	}
+
+	url := source.BaseWSURL + path.Join(to.Operation, "websocket")
+	migration, err := dest.MigrateFrom(name, url, secrets, status.Config, status.Profiles)
+	if err != nil {
+		return true, err
+	}
+
+	err = waitForMigration(dest, migration.Operation)
+	if !migrationUnreachable(err) {
+		return true, err
+	}
+
+	/* The source is still waiting for the target, which gave up */
+	if err := source.CancelOperation(to.Operation); err != nil {
+		shared.Debugf("Error cancelling %s: %s", to.Operation, err)
+	}
+
+	return false, err
+}
+
+/*
+ * migrationUnreachable tells whether a sink failed because it couldn't
+ * connect to the source.
+ */
+func migrationUnreachable(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), shared.MigrationUnreachable)
+}
+
+// migratePush migrates a container with the source connecting to the target.
+func migratePush(source *lxd.Client, dest *lxd.Client, name string, status *shared.ContainerState, containerOnly bool) error {
+	migration, err := dest.MigrateReceive(name, status.State() == lxc.RUNNING, status.Config, status.Profiles)
+	if err != nil {
+		return err
+	}
+
+	secrets := map[string]string{}
+	if err := json.Unmarshal(migration.Metadata, &secrets); err != nil {
+		return err
+	}
+
+	url := dest.BaseWSURL + path.Join(migration.Operation, "websocket")
+	from, err := source.MigratePush(name, url, secrets, containerOnly)
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * If the source can't reach the target either, only the source knows
+	 * why; the target just times out waiting for it.
+	 */
+	if err := waitForMigration(source, from.Operation); err != nil {
+		return err
+	}
+
+	return waitForMigration(dest, migration.Operation)
+}
+
+type migrationChannelProgress struct {
+	Bytes          int64 `json:"bytes"`
+	BytesPerSecond int64 `json:"bytes_per_second"`
+}
+
+/*
+ * migrationProgress describes the progress of the transfers of a running
+ * migration operation, or returns "" if it has none yet.
+ */
+func migrationProgress(op *shared.Operation) string {
+	md := struct {
+		Progress map[string]migrationChannelProgress `json:"progress"`
+	}{}
+	if err := json.Unmarshal(op.Metadata, &md); err != nil {
+		return ""
+	}
+
+	channels := []string{}
+	for channel := range md.Progress {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	result := []string{}
+	for _, channel := range channels {
+		p := md.Progress[channel]
+		result = append(result, fmt.Sprintf("%s: %s (%s/s)", channel, shared.GetByteSizeString(p.Bytes), shared.GetByteSizeString(p.BytesPerSecond)))
+	}
+
+	return strings.Join(result, ", ")
+}
+
+/*
+ * waitForMigration waits for a migration operation to finish, showing the
+ * progress of its transfers if stdout is a terminal.
+ */
+func waitForMigration(client *lxd.Client, operation string) error {
+	tty := terminal.IsTerminal(int(os.Stdout.Fd()))
+	shown := false
+
+	for {
+		op, err := client.WaitForTimeout(operation, 1)
+		if err != nil {
+			return err
+		}
+
+		if op.StatusCode.IsFinal() {
+			if shown {
+				fmt.Printf("\n")
+			}
+
+			switch op.StatusCode {
+			case shared.Success:
+				return nil
+			case shared.Cancelled:
+				return fmt.Errorf(gettext.Gettext("The migration was cancelled"))
+			}
+
+			return op.GetError()
+		}
+
+		if progress := migrationProgress(op); tty && progress != "" {
+			/* Clear what's left of the previous, maybe longer, line */
+			fmt.Printf("\r\033[K%s", progress)
+			shown = true
+		}
+	}
+}
+
 func (c *copyCmd) run(config *lxd.Config, args []string) error {
 	if len(args) != 2 {
 		return errArgs
 	}
 
-	return copyContainer(config, args[0], args[1], false)
+	return copyContainer(config, args[0], args[1], false, c.containerOnly)
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lxc/lxd/shared"
+)
+
+func TestMigrationUnreachable(t *testing.T) {
+	if migrationUnreachable(nil) {
+		t.Error("A successful migration is unreachable")
+	}
+
+	if !migrationUnreachable(fmt.Errorf("%s: dial tcp: i/o timeout", shared.MigrationUnreachable)) {
+		t.Error("An unreachable source wasn't detected")
+	}
+
+	for _, msg := range []string{"Timed out waiting for the other end to connect", "websocket: bad handshake", "Migration cancelled"} {
+		if migrationUnreachable(fmt.Errorf("%s", msg)) {
+			t.Errorf("%q is taken for an unreachable source", msg)
+		}
+	}
+}
@@ -62,7 +62,7 @@ func (c *deleteCmd) run(config *lxd.Config, args []string) error {
 	}
 
 	if ct.State() != lxc.STOPPED {
-		resp, err := d.Action(name, shared.Stop, -1, true)
+		resp, err := d.Action(name, shared.Stop, -1, true, false)
 		if err != nil {
 			return err
 		}
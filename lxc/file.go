@@ -12,12 +12,15 @@ import (
 	"github.com/gosexy/gettext"
 	"github.com/lxc/lxd"
 	"github.com/lxc/lxd/internal/gnuflag"
+	"github.com/lxc/lxd/shared"
 )
 
 type fileCmd struct {
 	uid  int
 	gid  int
 	mode string
+
+	recursive bool
 }
 
 func (c *fileCmd) showByDefault() bool {
@@ -28,16 +31,21 @@ func (c *fileCmd) usage() string {
 	return gettext.Gettext(
 		"Manage files on a container.\n" +
 			"\n" +
-			"lxc file pull <source> [<source>...] <target>\n" +
-			"lxc file push [--uid=UID] [--gid=GID] [--mode=MODE] <source> [<source>...] <target>\n" +
+			"lxc file pull [-r|--recursive] <source> [<source>...] <target>\n" +
+			"lxc file push [-r|--recursive] [--uid=UID] [--gid=GID] [--mode=MODE] <source> [<source>...] <target>\n" +
+			"lxc file delete [-r|--recursive] <container name>/<path> [<container name>/<path>...]\n" +
 			"\n" +
-			"<source> in the case of pull and <target> in the case of push are <container name>/<path>\n")
+			"<source> in the case of pull and <target> in the case of push are <container name>/<path>\n" +
+			"With --recursive, directories are copied along with their content, keeping the files' modes,\n" +
+			"and symlinks are copied as symlinks.\n")
 }
 
 func (c *fileCmd) flags() {
 	gnuflag.IntVar(&c.uid, "uid", -1, gettext.Gettext("Set the file's uid on push"))
 	gnuflag.IntVar(&c.gid, "gid", -1, gettext.Gettext("Set the file's gid on push"))
 	gnuflag.StringVar(&c.mode, "mode", "0644", gettext.Gettext("Set the file's perms on push"))
+	gnuflag.BoolVar(&c.recursive, "recursive", false, gettext.Gettext("Recursively push, pull or delete directories"))
+	gnuflag.BoolVar(&c.recursive, "r", false, gettext.Gettext("Recursively push, pull or delete directories"))
 }
 
 func (c *fileCmd) push(config *lxd.Config, args []string) error {
@@ -92,6 +100,16 @@ func (c *fileCmd) push(config *lxd.Config, args []string) error {
 		return errArgs
 	}
 
+	if c.recursive {
+		for _, f := range sourcefilenames {
+			if err := c.pushTree(d, container, f, path.Join(targetPath, filepath.Base(f)), uid, gid); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
 	/* Make sure all of the files are accessible by us before trying to
 	 * push any of them. */
 	var files []*os.File
@@ -163,11 +181,6 @@ func (c *fileCmd) pull(config *lxd.Config, args []string) error {
 			return err
 		}
 
-		_, _, _, buf, err := d.PullFile(container, pathSpec[1])
-		if err != nil {
-			return err
-		}
-
 		var targetPath string
 		if targetIsDir {
 			targetPath = path.Join(target, path.Base(pathSpec[1]))
@@ -175,16 +188,170 @@ func (c *fileCmd) pull(config *lxd.Config, args []string) error {
 			targetPath = target
 		}
 
-		f, err := os.Create(targetPath)
+		if err := c.pullTree(d, container, pathSpec[1], targetPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * pushTree pushes a local file, symlink or (with --recursive) directory and
+ * everything under it to p in the container, keeping the local modes.
+ */
+func (c *fileCmd) pushTree(d *lxd.Client, container string, source string, p string, uid int, gid int) error {
+	return filepath.Walk(source, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, fpath)
+		if err != nil {
+			return err
+		}
+		target := path.Join(p, filepath.ToSlash(rel))
+		mode := info.Mode() & os.ModePerm
+
+		switch {
+		case info.IsDir():
+			return d.MkdirFile(container, target, gid, uid, mode)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(fpath)
+			if err != nil {
+				return err
+			}
+			return d.PushSymlink(container, target, link, gid, uid)
+		case info.Mode().IsRegular():
+			f, err := os.Open(fpath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			return d.PushFile(container, target, gid, uid, mode, f)
+		default:
+			fmt.Fprintf(os.Stderr, gettext.Gettext("Skipping %s: not a file, a directory or a symlink")+"\n", fpath)
+			return nil
+		}
+	})
+}
+
+/*
+ * pullTree pulls p from the container into the local target. Symlinks are
+ * recreated as symlinks, and directories are only pulled with --recursive.
+ */
+func (c *fileCmd) pullTree(d *lxd.Client, container string, p string, target string) error {
+	_, _, mode, ftype, buf, err := d.PullFile(container, p)
+	if err != nil {
+		return err
+	}
+	defer buf.Close()
+
+	switch ftype {
+	case "file":
+		f, err := os.Create(target)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
 
 		_, err = io.Copy(f, buf)
+		return err
+	case "symlink":
+		var link string
+		if err := lxd.ParseFileMetadata(buf, &link); err != nil {
+			return err
+		}
+
+		os.Remove(target)
+		return os.Symlink(link, target)
+	case "directory":
+		if !c.recursive {
+			return fmt.Errorf(gettext.Gettext("%s is a directory, use --recursive to pull it"), p)
+		}
+
+		if err := os.MkdirAll(target, mode|0700); err != nil {
+			return err
+		}
+
+		entries := []shared.ContainerFileEntry{}
+		if err := lxd.ParseFileMetadata(buf, &entries); err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.Type != "file" && entry.Type != "directory" && entry.Type != "symlink" {
+				fmt.Fprintf(os.Stderr, gettext.Gettext("Skipping %s: not a file, a directory or a symlink")+"\n", path.Join(p, entry.Name))
+				continue
+			}
+
+			if err := c.pullTree(d, container, path.Join(p, entry.Name), filepath.Join(target, entry.Name)); err != nil {
+				return err
+			}
+		}
+
+		return os.Chmod(target, mode)
+	default:
+		return fmt.Errorf(gettext.Gettext("%s is not a file, a directory or a symlink"), p)
+	}
+}
+
+/*
+ * deleteTree deletes p, of type ftype, from the container, along with its
+ * content if it's a directory.
+ */
+func (c *fileCmd) deleteTree(d *lxd.Client, container string, p string, ftype string) error {
+	if ftype == "directory" {
+		entries, err := d.ListDirectory(container, p)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := c.deleteTree(d, container, path.Join(p, entry.Name), entry.Type); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.DeleteFile(container, p)
+}
+
+func (c *fileCmd) delete(config *lxd.Config, args []string) error {
+	if len(args) < 1 {
+		return errArgs
+	}
+
+	for _, f := range args {
+		pathSpec := strings.SplitN(f, "/", 2)
+		if len(pathSpec) != 2 {
+			return fmt.Errorf(gettext.Gettext("Invalid path %s"), f)
+		}
+
+		remote, container := config.ParseRemoteAndContainer(pathSpec[0])
+		d, err := lxd.NewClient(config, remote)
 		if err != nil {
 			return err
 		}
+
+		/*
+		 * Only the type is needed, the body (a whole file, maybe) is left
+		 * unread.
+		 */
+		ftype := ""
+		if c.recursive {
+			var buf io.ReadCloser
+			_, _, _, ftype, buf, err = d.PullFile(container, pathSpec[1])
+			if err != nil {
+				return err
+			}
+			buf.Close()
+		}
+
+		if err := c.deleteTree(d, container, pathSpec[1], ftype); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -200,6 +367,8 @@ func (c *fileCmd) run(config *lxd.Config, args []string) error {
 		return c.push(config, args[1:])
 	case "pull":
 		return c.pull(config, args[1:])
+	case "delete":
+		return c.delete(config, args[1:])
 	default:
 		return fmt.Errorf(gettext.Gettext("invalid argument %s"), args[0])
 	}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/gosexy/gettext"
 	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/shared"
 )
 
 type infoCmd struct{}
@@ -59,6 +62,33 @@ func (c *infoCmd) run(config *lxd.Config, args []string) error {
 		if !foundone {
 			fmt.Printf("(none)\n")
 		}
+
+		st, err := d.ContainerState(cName)
+		if err != nil {
+			return err
+		}
+
+		if m := st.Metrics; m != nil {
+			fmt.Printf(gettext.Gettext("Resources:\n"))
+			fmt.Printf(gettext.Gettext("  Processes: %d\n"), m.Processes)
+			fmt.Printf(gettext.Gettext("  CPU time: %s\n"), time.Duration(m.CPUTime))
+			fmt.Printf(gettext.Gettext("  Memory: %s (peak: %s)\n"), shared.GetByteSizeString(m.Memory), shared.GetByteSizeString(m.MemoryPeak))
+			fmt.Printf(gettext.Gettext("  Swap: %s\n"), shared.GetByteSizeString(m.Swap))
+			fmt.Printf(gettext.Gettext("  Disk: %s\n"), shared.GetByteSizeString(m.Disk))
+
+			names := []string{}
+			for name := range m.Network {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				n := m.Network[name]
+				fmt.Printf(gettext.Gettext("  %s: received %s (%d packets), sent %s (%d packets)\n"), name,
+					shared.GetByteSizeString(n.BytesReceived), n.PacketsReceived,
+					shared.GetByteSizeString(n.BytesSent), n.PacketsSent)
+			}
+		}
 	}
 
 	// List snapshots
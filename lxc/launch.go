@@ -110,7 +110,7 @@ func (c *launchCmd) run(config *lxd.Config, args []string) error {
 	fmt.Println("done")
 
 	fmt.Printf("Starting container...")
-	resp, err = d.Action(name, shared.Start, -1, false)
+	resp, err = d.Action(name, shared.Start, -1, false, false)
 	if err != nil {
 		return err
 	}
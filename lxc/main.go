@@ -111,10 +111,11 @@ var commands = map[string]command{
 	"list":     &listCmd{},
 	"move":     &moveCmd{},
 	"remote":   &remoteCmd{},
-	"restart":  &actionCmd{shared.Restart, true},
+	"restart":  &actionCmd{shared.Restart, true, false},
 	"snapshot": &snapshotCmd{},
-	"start":    &actionCmd{shared.Start, false},
-	"stop":     &actionCmd{shared.Stop, true},
+	"start":    &actionCmd{shared.Start, false, true},
+	"stop":     &actionCmd{shared.Stop, true, true},
+	"top":      &topCmd{},
 	"version":  &versionCmd{},
 }
 
@@ -3,11 +3,13 @@ package main
 import (
 	"github.com/gosexy/gettext"
 	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
 	"gopkg.in/lxc/go-lxc.v2"
 )
 
 type moveCmd struct {
-	httpAddr string
+	httpAddr      string
+	containerOnly bool
 }
 
 func (c *moveCmd) showByDefault() bool {
@@ -18,10 +20,15 @@ func (c *moveCmd) usage() string {
 	return gettext.Gettext(
 		"Move containers within or in between lxd instances.\n" +
 			"\n" +
-			"lxc move <source container> <destination container>\n")
+			"lxc move [--container-only] <source container> <destination container>\n" +
+			"\n" +
+			"Between lxd instances, the container's snapshots are moved along, unless --container-only is passed,\n" +
+			"in which case they're deleted with the source container.\n")
 }
 
-func (c *moveCmd) flags() {}
+func (c *moveCmd) flags() {
+	gnuflag.BoolVar(&c.containerOnly, "container-only", false, gettext.Gettext("Move the container without its snapshots"))
+}
 
 func (c *moveCmd) run(config *lxd.Config, args []string) error {
 	if len(args) != 2 {
@@ -58,7 +65,7 @@ func (c *moveCmd) run(config *lxd.Config, args []string) error {
 
 	// A move is just a copy followed by a delete; however, we want to
 	// keep the volatile entries around since we are moving the container.
-	if err := copyContainer(config, args[0], args[1], true); err != nil {
+	if err := copyContainer(config, args[0], args[1], true, c.containerOnly); err != nil {
 		return err
 	}
 
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gosexy/gettext"
+	"github.com/lxc/lxd"
+	"github.com/lxc/lxd/internal/gnuflag"
+	"github.com/lxc/lxd/shared"
+	"github.com/olekukonko/tablewriter"
+)
+
+type topCmd struct {
+	delay  int
+	once   bool
+	kill   int
+	signal int
+}
+
+func (c *topCmd) showByDefault() bool {
+	return true
+}
+
+func (c *topCmd) usage() string {
+	return gettext.Gettext(
+		"Show the processes running in a container.\n" +
+			"\n" +
+			"lxc top [remote:]<container> [--delay=<seconds>] [--once]\n" +
+			"lxc top [remote:]<container> --kill=<pid> [--signal=<number>]\n")
+}
+
+func (c *topCmd) flags() {
+	gnuflag.IntVar(&c.delay, "delay", 2, gettext.Gettext("Seconds between refreshes."))
+	gnuflag.BoolVar(&c.once, "once", false, gettext.Gettext("Show the processes once and exit."))
+	gnuflag.IntVar(&c.kill, "kill", 0, gettext.Gettext("Send a signal to the process with this pid (in the container) instead."))
+	gnuflag.IntVar(&c.signal, "signal", 15, gettext.Gettext("Signal to send with --kill."))
+}
+
+type topProcess struct {
+	shared.ContainerProcess
+	cpu float64
+}
+
+type topProcesses []topProcess
+
+func (p topProcesses) Len() int      { return len(p) }
+func (p topProcesses) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p topProcesses) Less(i, j int) bool {
+	if p[i].cpu != p[j].cpu {
+		return p[i].cpu > p[j].cpu
+	}
+	return p[i].Pid < p[j].Pid
+}
+
+/*
+ * topRender shows the processes, with their CPU usage over the time
+ * elapsed since the previous sample.
+ */
+func topRender(prev []shared.ContainerProcess, cur []shared.ContainerProcess, elapsed time.Duration) {
+	prevTimes := map[int]int64{}
+	for _, p := range prev {
+		prevTimes[p.HostPid] = p.CPUTime
+	}
+
+	processes := topProcesses{}
+	for _, p := range cur {
+		used := p.CPUTime - prevTimes[p.HostPid]
+		processes = append(processes, topProcess{p, 100 * float64(used) / float64(elapsed)})
+	}
+	sort.Sort(processes)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"PID", "PPID", "USER", "%CPU", "MEM", "TIME", "COMMAND"})
+
+	for _, p := range processes {
+		user := p.User
+		if user == "" {
+			user = fmt.Sprintf("%d", p.Uid)
+		}
+
+		table.Append([]string{
+			fmt.Sprintf("%d", p.Pid),
+			fmt.Sprintf("%d", p.ParentPid),
+			user,
+			fmt.Sprintf("%.1f", p.cpu),
+			shared.GetByteSizeString(p.Memory),
+			(time.Duration(p.CPUTime) / time.Second * time.Second).String(),
+			strings.Join(p.Command, " "),
+		})
+	}
+
+	table.Render()
+}
+
+func (c *topCmd) run(config *lxd.Config, args []string) error {
+	if len(args) != 1 {
+		return errArgs
+	}
+
+	remote, name := config.ParseRemoteAndContainer(args[0])
+	d, err := lxd.NewClient(config, remote)
+	if err != nil {
+		return err
+	}
+
+	if c.kill != 0 {
+		return d.SignalProcess(name, c.kill, c.signal)
+	}
+
+	if c.delay < 1 {
+		return fmt.Errorf(gettext.Gettext("The delay must be at least one second"))
+	}
+
+	prev, err := d.ContainerProcesses(name)
+	if err != nil {
+		return err
+	}
+	prevTime := time.Now()
+
+	for {
+		time.Sleep(time.Duration(c.delay) * time.Second)
+
+		cur, err := d.ContainerProcesses(name)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+
+		if !c.once {
+			/* Clear the screen */
+			fmt.Printf("\033[H\033[2J")
+		}
+		topRender(prev, cur, now.Sub(prevTime))
+
+		if c.once {
+			return nil
+		}
+
+		prev = cur
+		prevTime = now
+	}
+}
@@ -16,6 +16,7 @@ var api10 = []Command{
 	containersCmd,
 	containerCmd,
 	containerStateCmd,
+	containerProcessesCmd,
 	containerFileCmd,
 	containerSnapshotsCmd,
 	containerSnapshotCmd,
@@ -37,6 +38,8 @@ var api10 = []Command{
 	certificateFingerprintCmd,
 	profilesCmd,
 	profileCmd,
+	schemaCmd,
+	metricsCmd,
 }
 
 func api10Get(d *Daemon, r *http.Request) Response {
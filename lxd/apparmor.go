@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+const (
+	AA_PROFILE_BASE = `
+  ### Base profile
+  capability,
+  dbus,
+  file,
+  network,
+  umount,
+
+  # Allow us to receive signals from anywhere.
+  signal (receive),
+
+  # Allow us to send signals to ourselves
+  signal peer=@{profile_name},
+
+  # Allow other processes to read our /proc entries, futexes, perf tracing and
+  # kcmp for now (they will need 'read' in the first place).
+  ptrace (readby),
+
+  # Allow other processes to trace us by default (they will need 'trace' in
+  # the first place).
+  ptrace (tracedby),
+
+  # Allow us to ptrace ourselves
+  ptrace peer=@{profile_name},
+
+  #include <abstractions/lxc/container-base>
+`
+
+	AA_PROFILE_NESTING = `
+  ### Feature: nesting
+  #include <abstractions/lxc/start-container>
+
+  deny /dev/.lxc/proc/** rw,
+  deny /dev/.lxc/sys/** rw,
+
+  mount fstype=proc -> /var/cache/lxc/**,
+  mount fstype=sysfs -> /var/cache/lxc/**,
+  mount fstype=cgroup -> /sys/fs/cgroup/**,
+  mount options=(rw,bind),
+`
+
+	AA_PROFILE_UNPRIVILEGED = `
+  ### Feature: unprivileged
+  # The user namespace protects the host, so unprivileged containers may
+  # pivot_root and mount what the kernel lets them.
+  pivot_root,
+  mount options=(rw,make-slave) -> **,
+  mount options=(rw,make-rslave) -> **,
+  mount options=(rw,make-shared) -> **,
+  mount options=(rw,make-rshared) -> **,
+  mount options=(rw,make-private) -> **,
+  mount options=(rw,make-rprivate) -> **,
+  mount options=(rw,make-unbindable) -> **,
+  mount options=(rw,make-runbindable) -> **,
+  mount options=(rw,bind),
+  mount options=(rw,rbind),
+`
+)
+
+func aaPath(p ...string) string {
+	return shared.VarPath(append([]string{"security", "apparmor"}, p...)...)
+}
+
+/*
+ * aaAvailable tells whether containers can be confined, which requires
+ * the kernel to have AppArmor enabled and apparmor_parser to be installed.
+ */
+func aaAvailable() bool {
+	if !shared.PathExists("/sys/kernel/security/apparmor") {
+		return false
+	}
+
+	_, err := exec.LookPath("apparmor_parser")
+	return err == nil
+}
+
+func AAProfileName(name string) string {
+	return fmt.Sprintf("lxd-%s", name)
+}
+
+/*
+ * aaStacking tells whether the kernel can stack AppArmor profiles, which is
+ * what lets nested containers be confined by profiles of their own.
+ */
+func aaStacking() bool {
+	content, err := ioutil.ReadFile("/sys/kernel/security/apparmor/features/domain/stack")
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSpace(string(content)) == "yes"
+}
+
+/*
+ * AAProfileFull returns the lxc.aa_profile value of the container: its
+ * profile, stacked with the AppArmor namespace its own profiles get loaded
+ * into if it's nesting and the kernel supports that.
+ */
+func AAProfileFull(c *lxdContainer) string {
+	if isTrue(c.config["security.nesting"]) && aaStacking() {
+		return fmt.Sprintf("%s//&:%s:", AAProfileName(c.name), AANamespace(c.name))
+	}
+
+	return AAProfileName(c.name)
+}
+
+func AANamespace(name string) string {
+	return fmt.Sprintf("lxd-%s", name)
+}
+
+func aaNamespacePath(name string) string {
+	return fmt.Sprintf("/sys/kernel/security/apparmor/policy/namespaces/%s", AANamespace(name))
+}
+
+func aaProfilePath(name string) string {
+	return aaPath("profiles", AAProfileName(name))
+}
+
+// getAAProfileContent generates the AppArmor profile of the container.
+func getAAProfileContent(c *lxdContainer) string {
+	profile := "#include <tunables/global>\n"
+	profile += fmt.Sprintf("profile \"%s\" flags=(attach_disconnected,mediate_deleted) {\n", AAProfileName(c.name))
+	profile += AA_PROFILE_BASE
+
+	if isTrue(c.config["security.nesting"]) {
+		profile += AA_PROFILE_NESTING
+		profile += fmt.Sprintf(`
+  # Let the container load profiles into its namespace and use them
+  change_profile -> ":%s:*",
+  change_profile -> ":%s://*",
+`, AANamespace(c.name), AANamespace(c.name))
+	}
+
+	if !c.isPrivileged() {
+		profile += AA_PROFILE_UNPRIVILEGED
+	}
+
+	if raw := c.config["raw.apparmor"]; raw != "" {
+		profile += "\n  ### Configuration: raw.apparmor\n"
+		for _, line := range strings.Split(strings.Trim(raw, "\n"), "\n") {
+			profile += fmt.Sprintf("  %s\n", line)
+		}
+	}
+
+	return profile + "}\n"
+}
+
+func runApparmor(args ...string) error {
+	output, err := exec.Command("apparmor_parser", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("AppArmor failed: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+/*
+ * AALoadProfile writes the container's profile out and loads it (replacing
+ * whatever was loaded under the same name), failing on parser errors.
+ */
+func AALoadProfile(c *lxdContainer) error {
+	if !aaAvailable() {
+		return nil
+	}
+
+	if err := os.MkdirAll(aaPath("profiles"), 0700); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(aaPath("cache"), 0700); err != nil {
+		return err
+	}
+
+	if isTrue(c.config["security.nesting"]) && aaStacking() && !shared.PathExists(aaNamespacePath(c.name)) {
+		if err := os.Mkdir(aaNamespacePath(c.name), 0755); err != nil {
+			return fmt.Errorf("Failed to create the AppArmor namespace: %s", err)
+		}
+	}
+
+	if err := ioutil.WriteFile(aaProfilePath(c.name), []byte(getAAProfileContent(c)), 0600); err != nil {
+		return err
+	}
+
+	return runApparmor("-r", "-W", "-L", aaPath("cache"), aaProfilePath(c.name))
+}
+
+// AAUnloadProfile removes the container's profile from the kernel.
+func AAUnloadProfile(c *lxdContainer) error {
+	if !aaAvailable() || !shared.PathExists(aaProfilePath(c.name)) {
+		return nil
+	}
+
+	return runApparmor("-R", aaProfilePath(c.name))
+}
+
+// AADeleteProfile unloads the named container's profile and removes its
+// files and namespace.
+func AADeleteProfile(name string) {
+	if aaAvailable() && shared.PathExists(aaProfilePath(name)) {
+		runApparmor("-R", aaProfilePath(name))
+	}
+
+	if shared.PathExists(aaNamespacePath(name)) {
+		os.Remove(aaNamespacePath(name))
+	}
+
+	os.Remove(aaProfilePath(name))
+	os.Remove(aaPath("cache", AAProfileName(name)))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAAProfileContentUnprivileged(t *testing.T) {
+	c := &lxdContainer{name: "foo", config: map[string]string{}}
+	profile := getAAProfileContent(c)
+
+	if !strings.HasPrefix(profile, "#include <tunables/global>\nprofile \"lxd-foo\" flags=(attach_disconnected,mediate_deleted) {\n") {
+		t.Errorf("Bad profile header: %s", profile)
+	}
+
+	if !strings.HasSuffix(profile, "\n}\n") {
+		t.Errorf("Profile isn't closed: %s", profile)
+	}
+
+	if !strings.Contains(profile, AA_PROFILE_BASE) {
+		t.Error("Base profile is missing")
+	}
+
+	if !strings.Contains(profile, AA_PROFILE_UNPRIVILEGED) {
+		t.Error("Unprivileged container doesn't get the unprivileged rules")
+	}
+
+	if strings.Contains(profile, AA_PROFILE_NESTING) {
+		t.Error("Nesting rules without security.nesting")
+	}
+}
+
+func TestAAProfileContentPrivileged(t *testing.T) {
+	c := &lxdContainer{name: "foo", config: map[string]string{"security.privileged": "true"}}
+	profile := getAAProfileContent(c)
+
+	if strings.Contains(profile, AA_PROFILE_UNPRIVILEGED) {
+		t.Error("Privileged container gets the unprivileged rules")
+	}
+}
+
+func TestAAProfileContentNesting(t *testing.T) {
+	c := &lxdContainer{name: "foo", config: map[string]string{"security.nesting": "true"}}
+	profile := getAAProfileContent(c)
+
+	if !strings.Contains(profile, AA_PROFILE_NESTING) {
+		t.Error("Nesting rules are missing")
+	}
+
+	if !strings.Contains(profile, "change_profile -> \":lxd-foo:*\",") {
+		t.Error("Nested container can't switch to the profiles of its namespace")
+	}
+}
+
+func TestAAProfileContentRaw(t *testing.T) {
+	c := &lxdContainer{name: "foo", config: map[string]string{"raw.apparmor": "mount fstype=ext4,\ndeny /proc/kcore r,\n"}}
+	profile := getAAProfileContent(c)
+
+	if !strings.HasSuffix(profile, "  mount fstype=ext4,\n  deny /proc/kcore r,\n}\n") {
+		t.Errorf("raw.apparmor isn't appended at the end of the profile: %s", profile)
+	}
+}
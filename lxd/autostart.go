@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/shared"
+)
+
+/* How long containers get to shut down cleanly before they're killed */
+const hostShutdownTimeout = 30 * time.Second
+
+func containerBootPriority(c *lxdContainer) int {
+	priority, err := strconv.Atoi(configValue(c.config, "boot.autostart.priority"))
+	if err != nil {
+		return 0
+	}
+
+	return priority
+}
+
+func containerBootDelay(c *lxdContainer) time.Duration {
+	delay, err := strconv.Atoi(configValue(c.config, "boot.autostart.delay"))
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(delay) * time.Second
+}
+
+// containersLoadAll loads all the regular containers, skipping (and
+// logging) those which can't be loaded.
+func containersLoadAll(d *Daemon) ([]*lxdContainer, error) {
+	q := fmt.Sprintf("SELECT name FROM containers WHERE type=?")
+	inargs := []interface{}{cTypeRegular}
+	var name string
+	outfmt := []interface{}{name}
+
+	result, err := shared.DbQueryScan(d.db, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []*lxdContainer{}
+	for _, r := range result {
+		c, err := newLxdContainer(r[0].(string), d)
+		if err != nil {
+			shared.Logf("Failed to load container %s: %s", r[0].(string), err)
+			continue
+		}
+		containers = append(containers, c)
+	}
+
+	return containers, nil
+}
+
+/*
+ * containersByPriority groups containers by boot.autostart.priority, highest
+ * priority first.
+ */
+func containersByPriority(containers []*lxdContainer) [][]*lxdContainer {
+	groups := map[int][]*lxdContainer{}
+	priorities := []int{}
+	for _, c := range containers {
+		p := containerBootPriority(c)
+		if _, ok := groups[p]; !ok {
+			priorities = append(priorities, p)
+		}
+		groups[p] = append(groups[p], c)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	result := [][]*lxdContainer{}
+	for _, p := range priorities {
+		result = append(result, groups[p])
+	}
+
+	return result
+}
+
+/*
+ * containersAutostart starts the containers with boot.autostart set, highest
+ * boot.autostart.priority first. Containers of the same priority are
+ * started together, and the next ones only once the longest
+ * boot.autostart.delay among them has passed.
+ */
+func containersAutostart(d *Daemon) error {
+	containers, err := containersLoadAll(d)
+	if err != nil {
+		return err
+	}
+
+	toStart := []*lxdContainer{}
+	for _, c := range containers {
+		if isTrue(c.config["boot.autostart"]) && !c.c.Running() {
+			toStart = append(toStart, c)
+		}
+	}
+
+	var delay time.Duration
+	for _, group := range containersByPriority(toStart) {
+		time.Sleep(delay)
+		delay = 0
+
+		var wg sync.WaitGroup
+		for _, c := range group {
+			if containerBootDelay(c) > delay {
+				delay = containerBootDelay(c)
+			}
+
+			wg.Add(1)
+			go func(c *lxdContainer) {
+				defer wg.Done()
+				if err := c.Start(); err != nil {
+					shared.Logf("Failed to start container %s: %s", c.name, err)
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	return nil
+}
+
+/*
+ * containersShutdown shuts the running containers down as the host is going
+ * down, in the reverse of the order they're started in: containers without
+ * boot.autostart first, then the others by increasing priority.
+ */
+func containersShutdown(d *Daemon) error {
+	containers, err := containersLoadAll(d)
+	if err != nil {
+		return err
+	}
+
+	others := []*lxdContainer{}
+	autostart := []*lxdContainer{}
+	for _, c := range containers {
+		if !c.c.Running() {
+			continue
+		}
+
+		if isTrue(c.config["boot.autostart"]) {
+			autostart = append(autostart, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+
+	groups := [][]*lxdContainer{others}
+	byPriority := containersByPriority(autostart)
+	for i := len(byPriority) - 1; i >= 0; i-- {
+		groups = append(groups, byPriority[i])
+	}
+
+	for _, group := range groups {
+		var wg sync.WaitGroup
+		for _, c := range group {
+			wg.Add(1)
+			go func(c *lxdContainer) {
+				defer wg.Done()
+				if err := c.Shutdown(hostShutdownTimeout); err != nil {
+					shared.Logf("Failed to shut container %s down cleanly, killing it: %s", c.name, err)
+					c.Stop()
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestContainersByPriority(t *testing.T) {
+	containers := []*lxdContainer{
+		{name: "a", config: map[string]string{}},
+		{name: "b", config: map[string]string{"boot.autostart.priority": "10"}},
+		{name: "c", config: map[string]string{"boot.autostart.priority": "-1"}},
+		{name: "d", config: map[string]string{"boot.autostart.priority": "10"}},
+	}
+
+	groups := containersByPriority(containers)
+	expected := [][]string{{"b", "d"}, {"a"}, {"c"}}
+	if len(groups) != len(expected) {
+		t.Errorf("Expected %d groups, got %d", len(expected), len(groups))
+		return
+	}
+
+	for i, group := range groups {
+		if len(group) != len(expected[i]) {
+			t.Errorf("Bad group %d: %v", i, group)
+			continue
+		}
+
+		for j, c := range group {
+			if c.name != expected[i][j] {
+				t.Errorf("Expected %s in group %d, got %s", expected[i][j], i, c.name)
+			}
+		}
+	}
+}
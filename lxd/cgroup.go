@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+const (
+	CGROUP_PATH = "/sys/fs/cgroup"
+)
+
+/*
+ * Not every kernel has swap accounting enabled or the pids controller, and
+ * lxc refuses to start a container with a cgroup item it can't set, so we
+ * only ever emit those when the host supports them.
+ */
+func cgroupSwapAccounting() bool {
+	return shared.PathExists(fmt.Sprintf("%s/memory/memory.memsw.limit_in_bytes", CGROUP_PATH))
+}
+
+func cgroupPidsController() bool {
+	return shared.PathExists(fmt.Sprintf("%s/pids", CGROUP_PATH))
+}
+
+func hostMemoryTotal() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return kb * 1024, nil
+	}
+
+	return 0, fmt.Errorf("Couldn't find MemTotal in /proc/meminfo")
+}
+
+// parseMemoryLimit turns a limits.memory value into a number of bytes. The
+// value is either a percentage of the host's memory ("50%") or a size
+// understood by shared.ParseByteSizeString.
+func parseMemoryLimit(v string) (int64, error) {
+	if strings.HasSuffix(v, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("Invalid memory percentage: %s", v)
+		}
+
+		total, err := hostMemoryTotal()
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(float64(total) * percent / 100), nil
+	}
+
+	size, err := shared.ParseByteSizeString(v)
+	if err != nil {
+		return 0, err
+	}
+
+	if size <= 0 {
+		return 0, fmt.Errorf("Invalid memory limit: %s", v)
+	}
+
+	return size, nil
+}
+
+/*
+ * limitItems returns the cgroup items (without the "lxc.cgroup." prefix)
+ * implementing the container's memory and process limits, in the order they
+ * have to be set.
+ *
+ * When live is true, the items are meant to be applied to a running
+ * container, so limits which aren't set anymore are reset too, and the swap
+ * limit is lifted first since the kernel refuses a memory limit above it.
+ */
+func (c *lxdContainer) limitItems(live bool) ([][]string, error) {
+	items := [][]string{}
+	swapAccounting := cgroupSwapAccounting()
+
+	if live && swapAccounting {
+		items = append(items, []string{"memory.memsw.limit_in_bytes", "-1"})
+	}
+
+	allowSwap := isTrue(configValue(c.limits, "limits.memory.swap"))
+
+	if memory := c.limits["limits.memory"]; memory != "" {
+		limit, err := parseMemoryLimit(memory)
+		if err != nil {
+			return nil, err
+		}
+		value := strconv.FormatInt(limit, 10)
+
+		switch configValue(c.limits, "limits.memory.enforce") {
+		case "hard":
+			items = append(items, []string{"memory.limit_in_bytes", value})
+			if live {
+				items = append(items, []string{"memory.soft_limit_in_bytes", "-1"})
+			}
+
+			if !allowSwap && swapAccounting {
+				items = append(items, []string{"memory.memsw.limit_in_bytes", value})
+			}
+		case "soft":
+			items = append(items, []string{"memory.soft_limit_in_bytes", value})
+			if live {
+				items = append(items, []string{"memory.limit_in_bytes", "-1"})
+			}
+		default:
+			return nil, fmt.Errorf("Invalid value for limits.memory.enforce: %s", c.limits["limits.memory.enforce"])
+		}
+	} else if live {
+		items = append(items, []string{"memory.limit_in_bytes", "-1"})
+		items = append(items, []string{"memory.soft_limit_in_bytes", "-1"})
+	}
+
+	if !allowSwap {
+		items = append(items, []string{"memory.swappiness", "0"})
+	} else if live {
+		items = append(items, []string{"memory.swappiness", "60"})
+	}
+
+	if processes := c.limits["limits.processes"]; processes != "" {
+		if !cgroupPidsController() {
+			return nil, fmt.Errorf("limits.processes requires the pids cgroup controller")
+		}
+
+		items = append(items, []string{"pids.max", processes})
+	} else if live && cgroupPidsController() {
+		items = append(items, []string{"pids.max", "max"})
+	}
+
+	return items, nil
+}
+
+// applyLive applies the parts of the configuration which can change without
+// a restart to the running container.
+func (c *lxdContainer) applyLive() error {
+	items, err := c.limitItems(true)
+	if err != nil {
+		return err
+	}
+
+	for name, d := range c.devices {
+		if d["type"] != "disk" {
+			continue
+		}
+
+		diskItems, err := diskLimitItems(c, d, true)
+		if err != nil {
+			return fmt.Errorf("Failed configuring device %s: %s", name, err)
+		}
+		items = append(items, diskItems...)
+	}
+
+	for _, item := range items {
+		if err := c.c.SetCgroupItem(item[0], item[1]); err != nil {
+			return fmt.Errorf("Failed setting %s to %s: %s", item[0], item[1], err)
+		}
+	}
+
+	return c.applyNetworkLimits()
+}
+
+/*
+ * containerApplyLive reloads the named container's configuration and, if
+ * the container is running, applies it without restarting the container.
+ * oldDevices are the devices the container had before the change, which
+ * are diffed against the new ones to add and remove devices.
+ */
+func containerApplyLive(d *Daemon, name string, oldDevices shared.Devices) error {
+	c, err := newLxdContainer(name, d)
+	if err != nil {
+		return err
+	}
+
+	if !c.c.Running() {
+		return nil
+	}
+
+	/*
+	 * Without the old devices (the container wasn't running before),
+	 * those it has are the ones it was started with.
+	 */
+	var devErr error
+	if oldDevices != nil {
+		devErr = c.updateDevices(oldDevices)
+	}
+
+	if err := c.applyLive(); err != nil {
+		return err
+	}
+
+	return devErr
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+type configKeyType string
+
+const (
+	configTypeString configKeyType = "string"
+	configTypeBool   configKeyType = "boolean"
+	configTypeInt    configKeyType = "integer"
+	configTypeBlob   configKeyType = "blob"
+)
+
+/*
+ * configKey describes a container configuration key. Every key a container
+ * or profile may set has an entry in containerConfigKeys, which is what
+ * both validation and the schema exported at /1.0/schema are built from.
+ */
+type configKey struct {
+	Type        configKeyType `json:"type"`
+	Default     string        `json:"default"`
+	Description string        `json:"description"`
+
+	// LiveUpdate is set for keys whose changes are applied to running
+	// containers; changes to the others take effect on the next start.
+	LiveUpdate bool `json:"live_update"`
+
+	// Profile is set for keys which may be set in profiles as well as in
+	// containers.
+	Profile bool `json:"profile"`
+
+	/* Extra checks on top of those implied by the type */
+	validator func(value string) error
+}
+
+func (k configKey) validate(value string) error {
+	/* An empty value is the same as the key not being set */
+	if value == "" {
+		return nil
+	}
+
+	switch k.Type {
+	case configTypeBool:
+		switch strings.ToLower(value) {
+		case "1", "0", "true", "false":
+		default:
+			return fmt.Errorf("%q isn't a boolean", value)
+		}
+	case configTypeInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("%q isn't an integer", value)
+		}
+	}
+
+	if k.validator != nil {
+		return k.validator(value)
+	}
+
+	return nil
+}
+
+func isTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true":
+		return true
+	}
+
+	return false
+}
+
+func configValidRange(min int64, max int64) func(value string) error {
+	return func(value string) error {
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if v < min || v > max {
+			return fmt.Errorf("%d isn't between %d and %d", v, min, max)
+		}
+
+		return nil
+	}
+}
+
+func configValidChoice(choices ...string) func(value string) error {
+	return func(value string) error {
+		for _, choice := range choices {
+			if value == choice {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%q isn't one of %s", value, strings.Join(choices, ", "))
+	}
+}
+
+func configValidIdmap(value string) error {
+	_, err := parseContainerIdmap(value)
+	return err
+}
+
+var containerConfigKeys = map[string]configKey{
+	"boot.autostart": {
+		Type:        configTypeBool,
+		Default:     "false",
+		Description: "Whether to start the container when LXD starts",
+		LiveUpdate:  true,
+		Profile:     true,
+	},
+	"boot.autostart.delay": {
+		Type:        configTypeInt,
+		Default:     "0",
+		Description: "Number of seconds to wait after the container started before starting the next ones",
+		LiveUpdate:  true,
+		Profile:     true,
+		validator:   configValidRange(0, 1<<31-1),
+	},
+	"boot.autostart.priority": {
+		Type:        configTypeInt,
+		Default:     "0",
+		Description: "Order to start the containers in, highest first",
+		LiveUpdate:  true,
+		Profile:     true,
+	},
+	"limits.cpus": {
+		Type:        configTypeInt,
+		Description: "Number of CPUs to expose to the container",
+		Profile:     true,
+		validator:   configValidRange(1, 65000),
+	},
+	"limits.memory": {
+		Type:        configTypeString,
+		Description: "Percentage of the host's memory or fixed value in bytes",
+		LiveUpdate:  true,
+		Profile:     true,
+		validator: func(value string) error {
+			_, err := parseMemoryLimit(value)
+			return err
+		},
+	},
+	"limits.memory.enforce": {
+		Type:        configTypeString,
+		Default:     "hard",
+		Description: "Whether the memory limit is a hard or a soft limit",
+		LiveUpdate:  true,
+		Profile:     true,
+		validator:   configValidChoice("hard", "soft"),
+	},
+	"limits.memory.swap": {
+		Type:        configTypeBool,
+		Default:     "true",
+		Description: "Whether to allow the container to use swap",
+		LiveUpdate:  true,
+		Profile:     true,
+	},
+	"limits.processes": {
+		Type:        configTypeInt,
+		Description: "Maximum number of processes that can run in the container",
+		LiveUpdate:  true,
+		Profile:     true,
+		validator:   configValidRange(1, 1<<62),
+	},
+	"migration.incremental.memory": {
+		Type:        configTypeBool,
+		Default:     "false",
+		Description: "Pre-copy the container's memory while it keeps running when live migrating it",
+		LiveUpdate:  true,
+		Profile:     true,
+	},
+	"migration.incremental.memory.goal": {
+		Type:        configTypeInt,
+		Default:     "70",
+		Description: "Percentage of the memory which must be left unchanged by a pre-copy round to stop pre-copying",
+		LiveUpdate:  true,
+		Profile:     true,
+		validator:   configValidRange(1, 100),
+	},
+	"migration.incremental.memory.iterations": {
+		Type:        configTypeInt,
+		Default:     "10",
+		Description: "Most pre-copy rounds to do before the final dump",
+		LiveUpdate:  true,
+		Profile:     true,
+		validator:   configValidRange(1, 1000),
+	},
+	"raw.apparmor": {
+		Type:        configTypeBlob,
+		Description: "AppArmor profile entries to be appended to the generated profile",
+		Profile:     true,
+	},
+	"raw.lxc": {
+		Type:        configTypeBlob,
+		Description: "Raw LXC configuration to be appended to the generated one",
+		Profile:     true,
+	},
+	"raw.seccomp": {
+		Type:        configTypeBlob,
+		Description: "Seccomp policy replacing the generated one",
+		Profile:     true,
+	},
+	"security.privileged": {
+		Type:        configTypeBool,
+		Default:     "false",
+		Description: "Runs the container in privileged mode",
+		Profile:     true,
+	},
+	"security.idmap.isolated": {
+		Type:        configTypeBool,
+		Default:     "false",
+		Description: "Use a range of uids and gids which no other container uses",
+		Profile:     true,
+	},
+	"security.idmap.size": {
+		Type:        configTypeInt,
+		Default:     "65536",
+		Description: "Number of uids and gids in the isolated range",
+		Profile:     true,
+		validator:   configValidRange(65536, 1<<32-1),
+	},
+	"security.nesting": {
+		Type:        configTypeBool,
+		Default:     "false",
+		Description: "Allows running LXD and LXC inside the container",
+		Profile:     true,
+	},
+	"security.syscalls.blacklist": {
+		Type:        configTypeString,
+		Description: "Syscalls to deny on top of the default policy",
+		Profile:     true,
+		validator:   configValidSyscallList,
+	},
+	"security.syscalls.whitelist": {
+		Type:        configTypeString,
+		Description: "Syscalls to allow, all the others being denied",
+		Profile:     true,
+		validator:   configValidSyscallList,
+	},
+	"user.*": {
+		Type:        configTypeString,
+		Description: "Free form user key/value storage",
+		LiveUpdate:  true,
+		Profile:     true,
+	},
+	"volatile.idmap.current": {
+		Type:        configTypeString,
+		Description: "Map the container's rootfs is shifted to",
+		validator:   configValidIdmap,
+	},
+	"volatile.idmap.next": {
+		Type:        configTypeString,
+		Description: "Isolated map allocated to the container",
+		validator:   configValidIdmap,
+	},
+	"volatile.<name>.hwaddr": {
+		Type:        configTypeString,
+		Description: "MAC address generated by LXD for the nic device <name>",
+	},
+}
+
+// containerConfigKeyGet returns the registry entry describing the key k,
+// matching keys like user.foo against their namespace's entry.
+func containerConfigKeyGet(k string) (configKey, error) {
+	if key, ok := containerConfigKeys[k]; ok {
+		return key, nil
+	}
+
+	if strings.HasPrefix(k, "user.") {
+		return containerConfigKeys["user.*"], nil
+	}
+
+	if _, err := ExtractInterfaceFromConfigName(k); err == nil {
+		return containerConfigKeys["volatile.<name>.hwaddr"], nil
+	}
+
+	return configKey{}, fmt.Errorf("Unknown configuration key: %s", k)
+}
+
+// configValue returns the value of the key k in config, or its default.
+func configValue(config map[string]string, k string) string {
+	if v := config[k]; v != "" {
+		return v
+	}
+
+	key, err := containerConfigKeyGet(k)
+	if err != nil {
+		return ""
+	}
+
+	return key.Default
+}
+
+/*
+ * configRestartRequired returns the keys whose value differs between the
+ * two configurations and which aren't applied to running containers.
+ */
+func configRestartRequired(old map[string]string, new map[string]string) []string {
+	changed := map[string]bool{}
+	for _, config := range []map[string]string{old, new} {
+		for k := range config {
+			if old[k] != new[k] {
+				changed[k] = true
+			}
+		}
+	}
+
+	keys := []string{}
+	for k := range changed {
+		if key, err := containerConfigKeyGet(k); err == nil && key.LiveUpdate {
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+/*
+ * containerExpandConfig returns the configuration a container with the
+ * given profiles and configuration of its own runs with. profileConfigs
+ * has the new configuration of the profiles being changed, that of the
+ * others is read from the database.
+ */
+func containerExpandConfig(d *Daemon, profiles []string, profileConfigs map[string]map[string]string, config map[string]string) (map[string]string, error) {
+	expanded := map[string]string{}
+	for _, p := range profiles {
+		pconfig, ok := profileConfigs[p]
+		if !ok {
+			var err error
+			pconfig, err = dbGetProfileConfig(d, p)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for k, v := range pconfig {
+			expanded[k] = v
+		}
+	}
+
+	for k, v := range config {
+		expanded[k] = v
+	}
+
+	return expanded, nil
+}
+
+/*
+ * idmapConfigChanged tells whether the keys deciding which map a container
+ * runs with differ between the two configurations.
+ */
+func idmapConfigChanged(old map[string]string, new map[string]string) bool {
+	if isTrue(old["security.privileged"]) != isTrue(new["security.privileged"]) {
+		return true
+	}
+
+	isolated := isTrue(old["security.idmap.isolated"])
+	if isolated != isTrue(new["security.idmap.isolated"]) {
+		return true
+	}
+
+	return isolated && configValue(old, "security.idmap.size") != configValue(new, "security.idmap.size")
+}
+
+func ValidContainerConfigKey(k string) bool {
+	_, err := containerConfigKeyGet(k)
+	return err == nil
+}
+
+// containerValidConfig checks the keys and values of a container's (or, if
+// profile is set, a profile's) configuration against the key registry.
+func containerValidConfig(config map[string]string, profile bool) error {
+	for k, v := range config {
+		key, err := containerConfigKeyGet(k)
+		if err != nil {
+			return err
+		}
+
+		if profile && !key.Profile {
+			return fmt.Errorf("%s can't be set in a profile", k)
+		}
+
+		if err := key.validate(v); err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", k, err)
+		}
+	}
+
+	return containerValidExpandedConfig(config)
+}
+
+/*
+ * containerValidExpandedConfig checks the keys which can't be combined,
+ * which must be done on the configuration a container runs with, as they
+ * may come from different profiles or from the container itself.
+ */
+func containerValidExpandedConfig(config map[string]string) error {
+	if config["security.syscalls.whitelist"] != "" && config["security.syscalls.blacklist"] != "" {
+		return fmt.Errorf("security.syscalls.whitelist and security.syscalls.blacklist are mutually exclusive")
+	}
+
+	return nil
+}
+
+// containerValidDevices checks the devices of a container or a profile.
+func containerValidDevices(devices shared.Devices) error {
+	for name, d := range devices {
+		if !shared.ValidDeviceType(d["type"]) {
+			return fmt.Errorf("Invalid type for device %s: %s", name, d["type"])
+		}
+
+		for k, v := range d {
+			if k != "type" && !shared.ValidDeviceConfig(d["type"], k, v) {
+				return fmt.Errorf("Invalid value for %s of device %s: %s", k, name, v)
+			}
+		}
+	}
+
+	return nil
+}
+
+func schemaGet(d *Daemon, r *http.Request) Response {
+	return SyncResponse(true, map[string]interface{}{"config": containerConfigKeys})
+}
+
+var schemaCmd = Command{name: "schema", get: schemaGet}
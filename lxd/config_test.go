@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConfigValue(t *testing.T) {
+	config := map[string]string{"limits.memory.enforce": "soft", "limits.memory.swap": ""}
+
+	if v := configValue(config, "limits.memory.enforce"); v != "soft" {
+		t.Errorf("Expected soft, got %s", v)
+	}
+
+	if v := configValue(config, "limits.memory.swap"); v != "true" {
+		t.Errorf("Expected the default of true, got %s", v)
+	}
+
+	if v := configValue(config, "user.foo"); v != "" {
+		t.Errorf("Expected no default, got %s", v)
+	}
+}
+
+func TestConfigRestartRequired(t *testing.T) {
+	old := map[string]string{"limits.cpus": "1", "limits.memory": "1GB", "security.nesting": "true"}
+	new := map[string]string{"limits.cpus": "2", "limits.memory": "2GB", "user.foo": "bar"}
+
+	keys := configRestartRequired(old, new)
+	expected := []string{"limits.cpus", "security.nesting"}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, keys)
+	}
+
+	for i, k := range keys {
+		if k != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, keys)
+		}
+	}
+}
+
+func TestIdmapConfigChanged(t *testing.T) {
+	old := map[string]string{"security.idmap.isolated": "true"}
+
+	if idmapConfigChanged(old, map[string]string{"security.idmap.isolated": "1", "security.idmap.size": "65536"}) {
+		t.Error("Setting the default size isn't a change")
+	}
+
+	if !idmapConfigChanged(old, map[string]string{"security.idmap.isolated": "true", "security.idmap.size": "100000"}) {
+		t.Error("Changing the size of an isolated map is a change")
+	}
+
+	if idmapConfigChanged(map[string]string{}, map[string]string{"security.idmap.size": "100000"}) {
+		t.Error("The size only matters to isolated maps")
+	}
+
+	if !idmapConfigChanged(map[string]string{}, map[string]string{"security.privileged": "true"}) {
+		t.Error("Becoming privileged is a change")
+	}
+}
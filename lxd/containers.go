@@ -84,6 +84,7 @@ type containerImageSource struct {
 	Mode       string            `json:"mode"`
 	Operation  string            `json:"operation"`
 	Websockets map[string]string `json:"secrets"`
+	Live       bool              `json:"live"`
 
 	/* for "copy" type */
 	Source string `json:"source"`
@@ -209,6 +210,11 @@ func createFromImage(d *Daemon, req *containerPostReq) Response {
 		return SmartError(err)
 	}
 
+	if _, err := containerAllocateIdmap(d, name); err != nil {
+		removeContainer(d, name)
+		return SmartError(err)
+	}
+
 	resources := make(map[string][]string)
 	resources["containers"] = []string{req.Name}
 
@@ -221,6 +227,11 @@ func createFromNone(d *Daemon, req *containerPostReq) Response {
 		return SmartError(err)
 	}
 
+	if _, err := containerAllocateIdmap(d, req.Name); err != nil {
+		removeContainer(d, req.Name)
+		return SmartError(err)
+	}
+
 	/* The container already exists, so don't do anything. */
 	run := shared.OperationWrap(func() error { return nil })
 
@@ -232,7 +243,7 @@ func createFromNone(d *Daemon, req *containerPostReq) Response {
 
 func createFromMigration(d *Daemon, req *containerPostReq) Response {
 
-	if req.Source.Mode != "pull" {
+	if req.Source.Mode != "pull" && req.Source.Mode != "push" {
 		return NotImplemented
 	}
 
@@ -241,12 +252,25 @@ func createFromMigration(d *Daemon, req *containerPostReq) Response {
 		return SmartError(err)
 	}
 
-	c, err := newLxdContainer(req.Name, d)
+	c, err := containerAllocateIdmap(d, req.Name)
 	if err != nil {
 		removeContainer(d, req.Name)
 		return SmartError(err)
 	}
 
+	/* The sink shifts what it receives to the map the container gets here */
+	idmap, err := c.idmap.idmapSet()
+	if err != nil {
+		removeContainer(d, req.Name)
+		return InternalError(err)
+	}
+
+	if err := dbContainerConfigSet(d, c.id, "volatile.idmap.current", c.idmap.String()); err != nil {
+		removeContainer(d, req.Name)
+		return InternalError(err)
+	}
+	c.config["volatile.idmap.current"] = c.idmap.String()
+
 	// rsync complaisn if the parent directory for the rootfs sync doesn't
 	// exist
 	dpath := shared.VarPath("lxc", req.Name)
@@ -261,15 +285,55 @@ func createFromMigration(d *Daemon, req *containerPostReq) Response {
 		return InternalError(err)
 	}
 
+	progress := newMigrationProgress()
 	args := migration.MigrationSinkArgs{
 		Url:       req.Source.Operation,
 		Dialer:    websocket.Dialer{TLSClientConfig: config},
 		Container: c.c,
 		Secrets:   req.Source.Websockets,
-		IdMap:     d.idMap,
+		Idmap:     idmap,
+		Live:      req.Source.Live,
+		CreateSnapshot: func(snap *migration.Snapshot) error {
+			return migrationCreateSnapshot(d, req.Name, snap)
+		},
+		Restore: func(dir string) error {
+			if err := setUnprivUserAcl(c.idmap, dpath); err != nil {
+				shared.Debugf("Error adding acl for container root: restore will likely fail\n")
+			}
+			return c.restore(dir)
+		},
+		Progress: progress.update,
 	}
 
-	sink, err := migration.NewMigrationSink(&args)
+	resources := make(map[string][]string)
+	resources["containers"] = []string{req.Name}
+
+	/*
+	 * In push mode, the source connects to us, using the secrets in the
+	 * operation's metadata.
+	 */
+	if req.Source.Mode == "push" {
+		ws, cancel, err := migration.NewMigrationPushSink(&args)
+		if err != nil {
+			removeContainer(d, req.Name)
+			return InternalError(err)
+		}
+
+		run := func() shared.OperationResult {
+			result := ws.Do()
+			if result.Error != nil {
+				containerDeleteSnapshots(d, req.Name)
+				removeContainer(d, req.Name)
+			} else if err := setUnprivUserAcl(c.idmap, dpath); err != nil {
+				shared.Debugf("Error adding acl for container root: start will likely fail\n")
+			}
+			return result
+		}
+
+		return &asyncResponse{run: run, cancel: cancel, ws: ws, resources: resources, created: progress.setOperation}
+	}
+
+	sink, cancel, err := migration.NewMigrationSink(&args)
 	if err != nil {
 		removeContainer(d, req.Name)
 		return BadRequest(err)
@@ -278,15 +342,15 @@ func createFromMigration(d *Daemon, req *containerPostReq) Response {
 	run := func() shared.OperationResult {
 		err := sink()
 		if err != nil {
+			containerDeleteSnapshots(d, req.Name)
 			removeContainer(d, req.Name)
+		} else if err := setUnprivUserAcl(c.idmap, dpath); err != nil {
+			shared.Debugf("Error adding acl for container root: start will likely fail\n")
 		}
 		return shared.OperationError(err)
 	}
 
-	resources := make(map[string][]string)
-	resources["containers"] = []string{req.Name}
-
-	return &asyncResponse{run: run, resources: resources}
+	return &asyncResponse{run: run, cancel: cancel, resources: resources, created: progress.setOperation}
 }
 
 func createFromCopy(d *Daemon, req *containerPostReq) Response {
@@ -307,11 +371,28 @@ func createFromCopy(d *Daemon, req *containerPostReq) Response {
 		req.Profiles = source.profiles
 	}
 
-	_, err = dbCreateContainer(d, req.Name, cTypeRegular, req.Config, req.Profiles, req.Ephemeral)
+	id, err := dbCreateContainer(d, req.Name, cTypeRegular, req.Config, req.Profiles, req.Ephemeral)
 	if err != nil {
 		return SmartError(err)
 	}
 
+	if _, err := containerAllocateIdmap(d, req.Name); err != nil {
+		removeContainer(d, req.Name)
+		return SmartError(err)
+	}
+
+	/* The copy's rootfs is shifted the same way as that of its source */
+	sourceIdmap, err := source.currentIdmap()
+	if err != nil {
+		removeContainer(d, req.Name)
+		return InternalError(err)
+	}
+
+	if err := dbContainerConfigSet(d, id, "volatile.idmap.current", sourceIdmap.String()); err != nil {
+		removeContainer(d, req.Name)
+		return InternalError(err)
+	}
+
 	dpath := shared.VarPath("lxc", req.Name)
 	if err := os.MkdirAll(dpath, 0700); err != nil {
 		removeContainer(d, req.Name)
@@ -332,8 +413,8 @@ func createFromCopy(d *Daemon, req *containerPostReq) Response {
 	newPath := fmt.Sprintf("%s/%s", dpath, "rootfs")
 	run := func() shared.OperationResult {
 		err := exec.Command("rsync", "-a", "--devices", oldPath, newPath).Run()
-		if err == nil && !source.isPrivileged() {
-			err = setUnprivUserAcl(d, dpath)
+		if err == nil {
+			err = setUnprivUserAcl(sourceIdmap, dpath)
 		}
 		return shared.OperationError(err)
 	}
@@ -361,6 +442,28 @@ func containersPost(d *Daemon, r *http.Request) Response {
 		shared.Debugf("no name provided, creating %s", req.Name)
 	}
 
+	if err := containerValidName(req.Name); err != nil {
+		return BadRequest(err)
+	}
+
+	if err := containerValidConfig(req.Config, false); err != nil {
+		return BadRequest(err)
+	}
+
+	profiles := req.Profiles
+	if profiles == nil {
+		profiles = []string{"default"}
+	}
+
+	config, err := containerExpandConfig(d, profiles, nil, req.Config)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if err := containerValidExpandedConfig(config); err != nil {
+		return BadRequest(err)
+	}
+
 	switch req.Source.Type {
 	case "image":
 		return createFromImage(d, &req)
@@ -386,6 +489,15 @@ func removeContainerPath(d *Daemon, name string) {
 	}
 
 	if backing_fs == "btrfs" {
+		/* A subvolume with snapshot subvolumes in it can't be deleted */
+		snapshots, _ := ioutil.ReadDir(filepath.Join(cpath, "snapshots"))
+		for _, snap := range snapshots {
+			snapDir := filepath.Join(cpath, "snapshots", snap.Name())
+			if shared.IsBtrfsSubvolume(snapDir) {
+				exec.Command("btrfs", "subvolume", "delete", snapDir).Run()
+			}
+		}
+
 		exec.Command("btrfs", "subvolume", "delete", cpath).Run()
 	}
 
@@ -393,6 +505,11 @@ func removeContainerPath(d *Daemon, name string) {
 	if err != nil {
 		shared.Debugf("Error cleaning up %s: %s\n", cpath, err)
 	}
+
+	removeDevicesPath(name)
+	os.RemoveAll(shared.VarPath("shmounts", name))
+	AADeleteProfile(name)
+	seccompDeletePolicy(name)
 }
 
 func removeContainer(d *Daemon, name string) {
@@ -410,21 +527,11 @@ func btrfsCopyImage(hash string, name string, d *Daemon) error {
 		return err
 	}
 
-	rpath := shared.VarPath("lxc", name, "rootfs")
-	err = d.idMap.ShiftRootfs(rpath)
-	if err != nil {
-		shared.Debugf("Shift of rootfs %s failed: %s\n", rpath, err)
+	if err := shiftNewRootfs(d, name); err != nil {
 		removeContainer(d, name)
 		return err
 	}
 
-	/* Set an acl so the container root can descend the container dir */
-	acl := fmt.Sprintf("%d:rx", d.idMap.Uidmin)
-	_, err = exec.Command("setfacl", "-m", acl, dpath).Output()
-	if err != nil {
-		shared.Debugf("Error adding acl for container root: start will likely fail\n")
-	}
-
 	return nil
 }
 
@@ -468,16 +575,37 @@ func extractShiftRootfs(hash string, name string, d *Daemon) error {
 		return err
 	}
 
-	rpath := shared.VarPath("lxc", name, "rootfs")
-	err = d.idMap.ShiftRootfs(rpath)
+	if err := shiftNewRootfs(d, name); err != nil {
+		removeContainer(d, name)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * shiftNewRootfs shifts the rootfs of a container just created from an
+ * image, which isn't shifted at all, to the map the container is to run
+ * with.
+ */
+func shiftNewRootfs(d *Daemon, name string) error {
+	c, err := newLxdContainer(name, d)
 	if err != nil {
+		return err
+	}
+
+	rpath := shared.VarPath("lxc", name, "rootfs")
+	if err := shiftRootfs(rpath, nil, c.idmap); err != nil {
 		shared.Debugf("Shift of rootfs %s failed: %s\n", rpath, err)
-		removeContainer(d, name)
+		return err
+	}
+
+	if err := dbContainerConfigSet(d, c.id, "volatile.idmap.current", c.idmap.String()); err != nil {
 		return err
 	}
 
 	/* Set an acl so the container root can descend the container dir */
-	err = setUnprivUserAcl(d, dpath)
+	err = setUnprivUserAcl(c.idmap, shared.VarPath("lxc", name))
 	if err != nil {
 		shared.Debugf("Error adding acl for container root: start will likely fail\n")
 	}
@@ -485,8 +613,12 @@ func extractShiftRootfs(hash string, name string, d *Daemon) error {
 	return nil
 }
 
-func setUnprivUserAcl(d *Daemon, dpath string) error {
-	acl := fmt.Sprintf("%d:rx", d.idMap.Uidmin)
+func setUnprivUserAcl(idmap *containerIdmap, dpath string) error {
+	if idmap == nil {
+		return nil
+	}
+
+	acl := fmt.Sprintf("%d:rx", idmap.Uidbase)
 	_, err := exec.Command("setfacl", "-m", acl, dpath).Output()
 	return err
 }
@@ -495,6 +627,42 @@ func dbRemoveContainer(d *Daemon, name string) {
 	_, _ = shared.DbExec(d.db, "DELETE FROM containers WHERE name=?", name)
 }
 
+// dbRenameContainer renames a container and its snapshots, all at once.
+func dbRenameContainer(d *Daemon, oldName string, newName string) error {
+	prefix := fmt.Sprintf("%s/", oldName)
+	q := "SELECT name FROM containers WHERE type=? AND SUBSTR(name,1,?)=?"
+	var sname string
+	inargs := []interface{}{cTypeSnapshot, len(prefix), prefix}
+	outfmt := []interface{}{sname}
+	results, err := shared.DbQueryScan(d.db, q, inargs, outfmt)
+	if err != nil {
+		return err
+	}
+
+	tx, err := shared.DbBegin(d.db)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE containers SET name=? WHERE type=? AND name=?", newName, cTypeRegular, oldName)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, r := range results {
+		sname = r[0].(string)
+		newSname := fmt.Sprintf("%s/%s", newName, strings.TrimPrefix(sname, prefix))
+		_, err = tx.Exec("UPDATE containers SET name=? WHERE type=? AND name=?", newSname, cTypeSnapshot, sname)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return shared.TxCommit(tx)
+}
+
 func dbGetContainerId(db *sql.DB, name string) (int, error) {
 	q := "SELECT id FROM containers WHERE name=?"
 	id := -1
@@ -510,6 +678,10 @@ func dbCreateContainer(d *Daemon, name string, ctype containerType, config map[s
 		return 0, DbErrAlreadyDefined
 	}
 
+	if err := containerValidConfig(config, false); err != nil {
+		return 0, err
+	}
+
 	if profiles == nil {
 		profiles = []string{"default"}
 	}
@@ -646,6 +818,31 @@ func dbClearContainerConfig(tx *sql.Tx, id int) error {
 	return err
 }
 
+// dbContainerConfigSet sets a single configuration key of a container,
+// removing it if value is empty.
+func dbContainerConfigSet(d *Daemon, id int, key string, value string) error {
+	tx, err := shared.DbBegin(d.db)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM containers_config WHERE container_id=? AND key=?", id, key)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if value != "" {
+		_, err = tx.Exec("INSERT INTO containers_config (container_id, key, value) VALUES (?, ?, ?)", id, key, value)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return shared.TxCommit(tx)
+}
+
 func dbInsertContainerConfig(tx *sql.Tx, id int, config map[string]string) error {
 	str := "INSERT INTO containers_config (container_id, key, value) values (?, ?, ?)"
 	stmt, err := tx.Prepare(str)
@@ -705,35 +902,90 @@ func ExtractInterfaceFromConfigName(k string) (string, error) {
 	return "", fmt.Errorf("%s did not match", k)
 }
 
-func ValidContainerConfigKey(k string) bool {
-	switch k {
-	case "limits.cpus":
-		return true
-	case "limits.memory":
-		return true
-	case "security.privileged":
-		return true
-	case "raw.apparmor":
+func emptyProfile(l []string) bool {
+	if len(l) == 0 {
 		return true
-	case "raw.lxc":
+	}
+	if len(l) == 1 && l[0] == "" {
 		return true
 	}
+	return false
+}
 
-	if _, err := ExtractInterfaceFromConfigName(k); err == nil {
-		return true
+// dbUpdateContainer replaces the configuration, profiles and devices of a container.
+func dbUpdateContainer(d *Daemon, id int, config map[string]string, profiles []string, devices shared.Devices) error {
+	tx, err := shared.DbBegin(d.db)
+	if err != nil {
+		return err
+	}
+
+	/* Update config or profiles */
+	if err = dbClearContainerConfig(tx, id); err != nil {
+		shared.Debugf("Error clearing configuration for container %d\n", id)
+		tx.Rollback()
+		return err
+	}
+
+	if err = dbInsertContainerConfig(tx, id, config); err != nil {
+		shared.Debugf("Error inserting configuration for container %d\n", id)
+		tx.Rollback()
+		return err
+	}
+
+	/* handle profiles */
+	if !emptyProfile(profiles) {
+		if err := dbInsertProfiles(tx, id, profiles); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = shared.AddDevices(tx, "container", id, devices)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	return strings.HasPrefix(k, "user.")
+	return shared.TxCommit(tx)
 }
 
-func emptyProfile(l []string) bool {
-	if len(l) == 0 {
-		return true
+/*
+ * containerRestoreConfig puts back the configuration, profiles and devices
+ * a container had before a change which couldn't be applied, and applies
+ * them again if it's running. volatile.idmap.current is kept as it is now,
+ * since it records how the rootfs is shifted.
+ */
+func containerRestoreConfig(d *Daemon, name string, config map[string]string, profiles []string, devices shared.Devices) error {
+	c, err := newLxdContainer(name, d)
+	if err != nil {
+		return err
 	}
-	if len(l) == 1 && l[0] == "" {
-		return true
+
+	restored := map[string]string{}
+	for k, v := range config {
+		restored[k] = v
 	}
-	return false
+
+	delete(restored, "volatile.idmap.current")
+	if current := c.config["volatile.idmap.current"]; current != "" {
+		restored["volatile.idmap.current"] = current
+	}
+
+	/* The devices it runs with are now those of the failed change */
+	var running shared.Devices
+	if c.c.Running() {
+		running = c.devices
+	}
+
+	if err := dbUpdateContainer(d, c.id, restored, profiles, devices); err != nil {
+		return err
+	}
+
+	if _, err := containerAllocateIdmap(d, name); err != nil {
+		return err
+	}
+
+	return containerApplyLive(d, name, running)
 }
 
 /*
@@ -753,56 +1005,145 @@ func containerPut(d *Daemon, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
-	do := func() error {
+	if err := containerValidConfig(configRaw.Config, false); err != nil {
+		return BadRequest(err)
+	}
 
-		tx, err := shared.DbBegin(d.db)
+	if err := containerValidDevices(configRaw.Devices); err != nil {
+		return BadRequest(err)
+	}
+
+	config, err := containerExpandConfig(d, configRaw.Profiles, nil, configRaw.Config)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if err := containerValidExpandedConfig(config); err != nil {
+		return BadRequest(err)
+	}
+
+	/*
+	 * Switching between privileged and unprivileged, or to another map,
+	 * means shifting the rootfs, which can't be done under a running
+	 * container.
+	 */
+	c, err := newLxdContainer(name, d)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if c.c.Running() && idmapConfigChanged(c.expandedConfig(), config) {
+		return BadRequest(fmt.Errorf("security.privileged and security.idmap.* can't be changed while the container is running"))
+	}
+
+	var restartRequired []string
+	do := func() error {
+		c, err := newLxdContainer(name, d)
 		if err != nil {
 			return err
 		}
 
-		/* Update config or profiles */
-		if err = dbClearContainerConfig(tx, cId); err != nil {
-			shared.Debugf("Error clearing configuration for container %s\n", name)
-			tx.Rollback()
+		/* Remember the devices of a running container to update them */
+		var oldDevices shared.Devices
+		var oldConfig map[string]string
+		if c.c.Running() {
+			oldDevices = c.devices
+			oldConfig = c.expandedConfig()
+		}
+
+		/* And what to put back if the new configuration can't be applied */
+		ownDevices, err := dbGetDevices(d, name, false)
+		if err != nil {
 			return err
 		}
 
-		if err = dbInsertContainerConfig(tx, cId, configRaw.Config); err != nil {
-			shared.Debugf("Error inserting configuration for container %s\n", name)
-			tx.Rollback()
+		/* Keep track of how the rootfs is shifted */
+		if configRaw.Config == nil {
+			configRaw.Config = map[string]string{}
+		}
+		for _, k := range []string{"volatile.idmap.current", "volatile.idmap.next"} {
+			if _, ok := configRaw.Config[k]; !ok && c.config[k] != "" {
+				configRaw.Config[k] = c.config[k]
+			}
+		}
+
+		if err := dbUpdateContainer(d, cId, configRaw.Config, configRaw.Profiles, configRaw.Devices); err != nil {
 			return err
 		}
 
-		/* handle profiles */
-		if emptyProfile(configRaw.Profiles) {
-			_, err := tx.Exec("DELETE from containers_profiles where container_id=?", cId)
-			if err != nil {
-				tx.Rollback()
+		apply := func() error {
+			if _, err := containerAllocateIdmap(d, name); err != nil {
 				return err
 			}
-		} else {
-			if err := dbInsertProfiles(tx, cId, configRaw.Profiles); err != nil {
 
-				tx.Rollback()
+			if err := containerApplyLive(d, name, oldDevices); err != nil {
+				return err
+			}
+
+			/*
+			 * Shift the rootfs of a stopped container to its new
+			 * map right away rather than when it's next started.
+			 */
+			c, err := newLxdContainer(name, d)
+			if err != nil {
 				return err
 			}
+
+			if c.c.Running() {
+				if oldConfig != nil {
+					restartRequired = configRestartRequired(oldConfig, c.expandedConfig())
+				}
+				return nil
+			}
+
+			return c.shiftIdmap()
 		}
 
-		err = shared.AddDevices(tx, "container", cId, configRaw.Devices)
-		if err != nil {
-			tx.Rollback()
+		if err := apply(); err != nil {
+			if err2 := containerRestoreConfig(d, name, c.config, c.profiles, ownDevices); err2 != nil {
+				shared.Debugf("Error restoring the configuration of %s: %s\n", name, err2)
+			}
 			return err
 		}
 
-		return shared.TxCommit(tx)
+		return nil
 	}
 
-	return AsyncResponse(shared.OperationWrap(do), nil)
+	/* Tell which of the changes only apply once the container restarts */
+	run := func() shared.OperationResult {
+		if err := do(); err != nil {
+			return shared.OperationError(err)
+		}
+
+		if len(restartRequired) == 0 {
+			return shared.OperationSuccess
+		}
+
+		md, err := json.Marshal(shared.Jmap{"restart_required": restartRequired})
+		if err != nil {
+			return shared.OperationError(err)
+		}
+
+		return shared.OperationResult{Metadata: md}
+	}
+
+	return AsyncResponse(run, nil)
+}
+
+/*
+ * containerPostBodyTarget is set to push the container to a sink in push
+ * mode, rather than waiting for the sink to pull it.
+ */
+type containerPostBodyTarget struct {
+	Operation  string            `json:"operation"`
+	Websockets map[string]string `json:"secrets"`
 }
 
 type containerPostBody struct {
-	Migration bool   `json:"migration"`
-	Name      string `json:"name"`
+	Migration     bool                     `json:"migration"`
+	Name          string                   `json:"name"`
+	Target        *containerPostBodyTarget `json:"target"`
+	ContainerOnly bool                     `json:"container_only"`
 }
 
 func containerPost(d *Daemon, r *http.Request) Response {
@@ -822,37 +1163,142 @@ func containerPost(d *Daemon, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
-	if body.Migration {
-		ws, err := migration.NewMigrationSource(c.c)
+	if body.Migration && body.Target != nil {
+		args, err := migrationSourceArgs(d, c, body.ContainerOnly)
 		if err != nil {
 			return InternalError(err)
 		}
 
-		return AsyncResponseWithWs(ws, nil)
+		config, err := shared.GetTLSConfig(d.certf, d.keyf)
+		if err != nil {
+			return InternalError(err)
+		}
+
+		args.Url = body.Target.Operation
+		args.Dialer = websocket.Dialer{TLSClientConfig: config}
+		args.Secrets = body.Target.Websockets
+
+		progress := newMigrationProgress()
+		args.Progress = progress.update
+
+		run, cancel, err := migration.NewMigrationSourcePush(args)
+		if err != nil {
+			return BadRequest(err)
+		}
+
+		return &asyncResponse{run: run, cancel: cancel, created: progress.setOperation}
+	} else if body.Migration {
+		args, err := migrationSourceArgs(d, c, body.ContainerOnly)
+		if err != nil {
+			return InternalError(err)
+		}
+
+		progress := newMigrationProgress()
+		args.Progress = progress.update
+
+		ws, cancel, err := migration.NewMigrationSource(args)
+		if err != nil {
+			return InternalError(err)
+		}
+
+		return &asyncResponse{run: ws.Do, cancel: cancel, ws: ws, created: progress.setOperation}
 	} else {
 		if c.c.Running() {
 			return BadRequest(fmt.Errorf("renaming of running container not allowed"))
 		}
 
-		_, err := dbCreateContainer(d, body.Name, cTypeRegular, c.config, c.profiles, c.ephemeral)
-		if err != nil {
-			return SmartError(err)
+		if err := containerValidName(body.Name); err != nil {
+			return BadRequest(err)
+		}
+
+		if _, err := dbGetContainerId(d.db, body.Name); err == nil {
+			return Conflict
 		}
 
 		run := func() error {
-			oldPath := fmt.Sprintf("%s/", shared.VarPath("lxc", c.name))
-			newPath := fmt.Sprintf("%s/", shared.VarPath("lxc", body.Name))
+			return containerRename(d, c, body.Name)
+		}
 
-			if err := os.Rename(oldPath, newPath); err != nil {
-				return err
-			}
+		return AsyncResponse(shared.OperationWrap(run), nil)
+	}
+}
+
+/*
+ * containerValidName checks a new container's name, which is used as is in
+ * paths.
+ */
+func containerValidName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid container name: %q", name)
+	}
+
+	return nil
+}
+
+/*
+ * containerRename renames a stopped container along with its snapshots and
+ * logs. Everything done is undone if any step fails, leaving the container
+ * as it was. Things LXD generates from the name (devices, AppArmor profile,
+ * seccomp policy) are dropped, they're generated again on the next start.
+ */
+func containerRename(d *Daemon, c *lxdContainer, newName string) error {
+	undo := []func(){}
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
 
-			removeContainer(d, c.name)
+	move := func(oldPath string, newPath string) error {
+		if !shared.PathExists(oldPath) {
 			return nil
 		}
 
-		return AsyncResponse(shared.OperationWrap(run), nil)
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return err
+		}
+
+		undo = append(undo, func() { os.Rename(newPath, oldPath) })
+		return nil
 	}
+
+	if err := move(shared.VarPath("lxc", c.name), shared.VarPath("lxc", newName)); err != nil {
+		rollback()
+		return err
+	}
+
+	/*
+	 * Whatever logs are there are those of a deleted container. They're
+	 * set aside, and only removed once the rename can't fail anymore.
+	 */
+	stale, err := ioutil.TempDir(shared.LogPath(), ".stale_")
+	if err != nil {
+		rollback()
+		return err
+	}
+	defer os.RemoveAll(stale)
+
+	if err := move(shared.LogPath(newName), filepath.Join(stale, "log")); err != nil {
+		rollback()
+		return err
+	}
+
+	if err := move(shared.LogPath(c.name), shared.LogPath(newName)); err != nil {
+		rollback()
+		return err
+	}
+
+	if err := dbRenameContainer(d, c.name, newName); err != nil {
+		rollback()
+		return err
+	}
+
+	removeDevicesPath(c.name)
+	os.RemoveAll(shared.VarPath("shmounts", c.name))
+	AADeleteProfile(c.name)
+	seccompDeletePolicy(c.name)
+
+	return nil
 }
 
 func containerDelete(d *Daemon, r *http.Request) Response {
@@ -879,13 +1325,19 @@ func containerStateGet(d *Daemon, r *http.Request) Response {
 		return SmartError(err)
 	}
 
-	return SyncResponse(true, c.RenderState().Status)
+	status := c.RenderState().Status
+	if c.c.Running() {
+		status.Metrics = c.metrics()
+	}
+
+	return SyncResponse(true, status)
 }
 
 type containerStatePutReq struct {
-	Action  string `json:"action"`
-	Timeout int    `json:"timeout"`
-	Force   bool   `json:"force"`
+	Action   string `json:"action"`
+	Timeout  int    `json:"timeout"`
+	Force    bool   `json:"force"`
+	Stateful bool   `json:"stateful"`
 }
 
 type lxdContainer struct {
@@ -897,28 +1349,121 @@ type lxdContainer struct {
 	profiles  []string
 	devices   shared.Devices
 	ephemeral bool
+	limits    map[string]string
+	idmap     *containerIdmap
+
+	/* Set if the isolated range it asks for isn't allocated yet */
+	idmapPending bool
 }
 
-func (c *lxdContainer) RenderState() *shared.ContainerState {
-	return &shared.ContainerState{
-		Name:      c.name,
-		Profiles:  c.profiles,
-		Config:    c.config,
-		Userdata:  []byte{},
-		Status:    shared.NewStatus(c.c, c.c.State()),
-		Devices:   c.devices,
-		Ephemeral: c.ephemeral,
+/*
+ * expandedConfig returns the configuration the container runs with, that of
+ * its profiles overridden by its own.
+ */
+func (c *lxdContainer) expandedConfig() map[string]string {
+	config := map[string]string{}
+	for k, v := range c.config {
+		config[k] = v
+	}
+
+	for k, v := range c.limits {
+		config[k] = v
+	}
+
+	return config
+}
+
+func (c *lxdContainer) RenderState() *shared.ContainerState {
+	return &shared.ContainerState{
+		Name:      c.name,
+		Profiles:  c.profiles,
+		Config:    c.config,
+		Userdata:  []byte{},
+		Status:    shared.NewStatus(c.c, c.c.State()),
+		Devices:   c.devices,
+		Ephemeral: c.ephemeral,
+		Stateful:  shared.PathExists(c.stateDir()),
+	}
+}
+
+// stateDir is where the state of a statefully stopped container is kept.
+func (c *lxdContainer) stateDir() string {
+	return shared.VarPath("lxc", c.name, "state")
+}
+
+func (c *lxdContainer) clearState() error {
+	return os.RemoveAll(c.stateDir())
+}
+
+func (c *lxdContainer) Start() error {
+	return c.start(false)
+}
+
+/*
+ * StartStateful restores the container from the state it was stopped with,
+ * if it was stopped statefully, and starts it normally otherwise.
+ */
+func (c *lxdContainer) StartStateful() error {
+	return c.start(true)
+}
+
+func (c *lxdContainer) start(stateful bool) error {
+	if stateful && shared.PathExists(c.stateDir()) {
+		return c.restore(c.stateDir())
+	}
+
+	return c.restore("")
+}
+
+/*
+ * restore starts the container from the CRIU dump in dir, setting up what it
+ * needs on the host first. It starts the container normally if dir is empty.
+ */
+func (c *lxdContainer) restore(dir string) error {
+	if err := c.shiftIdmap(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(shared.VarPath("shmounts", c.name), 0711); err != nil {
+		return err
+	}
+
+	if err := c.setupDevices(); err != nil {
+		return err
+	}
+
+	if err := AALoadProfile(c); err != nil {
+		return err
+	}
+
+	var err error
+	if dir != "" {
+		opts := lxc.RestoreOptions{Directory: dir, Verbose: true}
+		err = c.c.Restore(opts)
+	} else {
+		err = c.c.Start()
+	}
+	if err != nil {
+		c.stopped()
+		return err
+	}
+
+	/* Once the container runs again, whatever state it had is stale */
+	if err := c.clearState(); err != nil {
+		shared.Debugf("Error removing the state of %s: %s\n", c.name, err)
 	}
-}
 
-func (c *lxdContainer) Start() error {
-	err := c.c.Start()
+	if err := c.applyNetworkLimits(); err != nil {
+		c.c.Stop()
+		c.stopped()
+		return err
+	}
 
-	if err == nil && c.ephemeral == true {
+	if c.ephemeral == true {
 		containerWatchEphemeral(c)
 	}
 
-	return err
+	return nil
 }
 
 func (c *lxdContainer) Reboot() error {
@@ -930,21 +1475,55 @@ func (c *lxdContainer) Freeze() error {
 }
 
 func (c *lxdContainer) isPrivileged() bool {
-	switch strings.ToLower(c.config["security.privileged"]) {
-	case "1":
-		return true
-	case "true":
-		return true
-	}
-	return false
+	return isTrue(c.config["security.privileged"])
+}
+
+/*
+ * stopped cleans up what start set up on the host for the container, once
+ * it stopped.
+ */
+func (c *lxdContainer) stopped() error {
+	unmountDiskSources(c.name, nil)
+	return AAUnloadProfile(c)
 }
 
 func (c *lxdContainer) Shutdown(timeout time.Duration) error {
-	return c.c.Shutdown(timeout)
+	if err := c.c.Shutdown(timeout); err != nil {
+		return err
+	}
+
+	return c.stopped()
 }
 
 func (c *lxdContainer) Stop() error {
-	return c.c.Stop()
+	if err := c.c.Stop(); err != nil {
+		return err
+	}
+
+	return c.stopped()
+}
+
+// StopStateful checkpoints the container into its state dir and stops it.
+func (c *lxdContainer) StopStateful() error {
+	if !c.c.Running() {
+		return fmt.Errorf("Container not running")
+	}
+
+	if err := c.clearState(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.stateDir(), 0700); err != nil {
+		return err
+	}
+
+	opts := lxc.CheckpointOptions{Directory: c.stateDir(), Stop: true, Verbose: true}
+	if err := c.c.Checkpoint(opts); err != nil {
+		c.clearState()
+		return err
+	}
+
+	return c.stopped()
 }
 
 func (c *lxdContainer) Unfreeze() error {
@@ -952,24 +1531,43 @@ func (c *lxdContainer) Unfreeze() error {
 }
 
 func (d *lxdContainer) applyConfig(config map[string]string) error {
-	var err error
 	for k, v := range config {
+		/*
+		 * Values are validated when they're set; anything invalid
+		 * stored by older versions of LXD is ignored rather than
+		 * making the container impossible to load.
+		 */
+		key, err := containerConfigKeyGet(k)
+		if err == nil {
+			err = key.validate(v)
+		}
+		if err != nil {
+			shared.Debugf("ignoring %s of container %s: %s", k, d.name, err)
+			continue
+		}
+
 		switch k {
 		case "limits.cpus":
+			if v == "" {
+				continue
+			}
+
 			// TODO - Come up with a way to choose cpus for multiple
 			// containers
-			var vint int
-			count, err := fmt.Sscanf(v, "%d", &vint)
+			var count int
+			count, err = strconv.Atoi(v)
 			if err != nil {
 				return err
 			}
-			if count != 1 || vint < 0 || vint > 65000 {
-				return fmt.Errorf("Bad cpu limit: %s\n", v)
-			}
-			cpuset := fmt.Sprintf("0-%d", vint-1)
+			cpuset := fmt.Sprintf("0-%d", count-1)
 			err = d.c.SetConfigItem("lxc.cgroup.cpuset.cpus", cpuset)
-		case "limits.memory":
-			err = d.c.SetConfigItem("lxc.cgroup.memory.limit_in_bytes", v)
+		case "limits.memory", "limits.memory.enforce", "limits.memory.swap", "limits.processes":
+			/*
+			 * These depend on each other, so they're only turned
+			 * into cgroup items once all profiles and the
+			 * container's own config have been applied.
+			 */
+			d.limits[k] = v
 
 		default:
 			if strings.HasPrefix(k, "user.") {
@@ -1007,6 +1605,36 @@ func (d *lxdContainer) applyConfig(config map[string]string) error {
 	return nil
 }
 
+/*
+ * setupNesting adds what LXD and LXC need to run inside the container:
+ * uncovered mounts of proc and sys (which they can't mount otherwise, parts
+ * of those being covered), the devices they pass on to their own
+ * containers and an AppArmor profile stacked with a namespace of its own.
+ * cgroup:mixed already lets them create cgroups below the container's.
+ */
+func (c *lxdContainer) setupNesting() error {
+	items := [][]string{
+		{"lxc.mount.entry", "proc dev/.lxc/proc proc create=dir,optional 0 0"},
+		{"lxc.mount.entry", "sys dev/.lxc/sys sysfs create=dir,optional 0 0"},
+		{"lxc.cgroup.devices.allow", "c 10:229 rwm"},
+		{"lxc.cgroup.devices.allow", "c 10:200 rwm"},
+	}
+
+	/* Unless raw.lxc picked another profile */
+	profile := c.c.ConfigItem("lxc.aa_profile")
+	if aaAvailable() && len(profile) == 1 && profile[0] == AAProfileName(c.name) {
+		items = append(items, []string{"lxc.aa_profile", AAProfileFull(c)})
+	}
+
+	for _, item := range items {
+		if err := c.c.SetConfigItem(item[0], item[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func applyProfile(daemon *Daemon, d *lxdContainer, p string) error {
 	q := `SELECT key, value FROM profiles_config
 		JOIN profiles ON profiles.id=profiles_config.profile_id
@@ -1085,6 +1713,11 @@ func (c *lxdContainer) setupMacAddresses(d *Daemon) error {
 			continue
 		}
 
+		/* Physical nics keep their own address unless one is set */
+		if d["nictype"] == "physical" && d["hwaddr"] == "" {
+			continue
+		}
+
 		found := false
 
 		for key, val := range c.config {
@@ -1206,7 +1839,7 @@ func (c *lxdContainer) applyDevices() error {
 			continue
 		}
 
-		configs, err := DeviceToLxc(d)
+		configs, err := DeviceToLxc(c, d)
 		if err != nil {
 			return fmt.Errorf("Failed configuring device %s: %s\n", name, err)
 		}
@@ -1282,11 +1915,21 @@ func newLxdContainer(name string, daemon *Daemon) (*lxdContainer, error) {
 		return nil, err
 	}
 
+	if aaAvailable() {
+		err = c.SetConfigItem("lxc.aa_profile", AAProfileName(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	config, err := dbGetConfig(daemon, d)
 	if err != nil {
 		return nil, err
 	}
-	d.config = config
+	d.config = map[string]string{}
+	for k, v := range config {
+		d.config[k] = v
+	}
 
 	profiles, err := dbGetProfiles(daemon, d)
 	if err != nil {
@@ -1294,6 +1937,7 @@ func newLxdContainer(name string, daemon *Daemon) (*lxdContainer, error) {
 	}
 	d.profiles = profiles
 	d.devices = shared.Devices{}
+	d.limits = map[string]string{}
 	d.name = name
 
 	rootfsPath := shared.VarPath("lxc", name, "rootfs")
@@ -1318,6 +1962,10 @@ func newLxdContainer(name string, daemon *Daemon) (*lxdContainer, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = c.SetConfigItem("lxc.mount.entry", fmt.Sprintf("%s dev/.lxd-mounts none bind,create=dir 0 0", shared.VarPath("shmounts", name)))
+	if err != nil {
+		return nil, err
+	}
 
 	/* apply profiles */
 	for _, p := range profiles {
@@ -1347,23 +1995,52 @@ func newLxdContainer(name string, daemon *Daemon) (*lxdContainer, error) {
 		return nil, err
 	}
 
-	if !d.isPrivileged() {
-		uidstr := fmt.Sprintf("u 0 %d %d\n", daemon.idMap.Uidmin, daemon.idMap.Uidrange)
+	/* The container's own config takes precedence over its profiles' */
+	err = d.applyConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.setupIdmap()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.setupSeccomp()
+	if err != nil {
+		return nil, err
+	}
+
+	if isTrue(d.config["security.nesting"]) {
+		err = d.setupNesting()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if d.idmap != nil {
+		uidstr := fmt.Sprintf("u 0 %d %d\n", d.idmap.Uidbase, d.idmap.Size)
 		err = c.SetConfigItem("lxc.id_map", uidstr)
 		if err != nil {
 			return nil, err
 		}
-		gidstr := fmt.Sprintf("g 0 %d %d\n", daemon.idMap.Gidmin, daemon.idMap.Gidrange)
+		gidstr := fmt.Sprintf("g 0 %d %d\n", d.idmap.Gidbase, d.idmap.Size)
 		err = c.SetConfigItem("lxc.id_map", gidstr)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	err = d.applyConfig(d.config)
+	limits, err := d.limitItems(false)
 	if err != nil {
 		return nil, err
 	}
+	for _, item := range limits {
+		err = c.SetConfigItem(fmt.Sprintf("lxc.cgroup.%s", item[0]), item[1])
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return d, nil
 }
@@ -1386,12 +2063,23 @@ func containerStatePut(d *Daemon, r *http.Request) Response {
 		return SmartError(err)
 	}
 
+	action := shared.ContainerAction(raw.Action)
+	if raw.Stateful && action != shared.Start && action != shared.Stop {
+		return BadRequest(fmt.Errorf("Only start and stop can be stateful"))
+	}
+
 	var do func() error
-	switch shared.ContainerAction(raw.Action) {
+	switch action {
 	case shared.Start:
-		do = c.Start
+		if raw.Stateful {
+			do = c.StartStateful
+		} else {
+			do = c.Start
+		}
 	case shared.Stop:
-		if raw.Timeout == 0 || raw.Force {
+		if raw.Stateful {
+			do = c.StopStateful
+		} else if raw.Timeout == 0 || raw.Force {
 			do = c.Stop
 		} else {
 			do = func() error { return c.Shutdown(time.Duration(raw.Timeout) * time.Second) }
@@ -1437,90 +2125,352 @@ func containerFileHandler(d *Daemon, r *http.Request) Response {
 	/*
 	 * Make sure someone didn't pass in ../../../etc/shadow or something.
 	 */
-	p := path.Clean(path.Join(rootfs, targetPath))
-	if !strings.HasPrefix(p, path.Clean(rootfs)) {
-		return BadRequest(fmt.Errorf("%s is not in the container's rootfs", p))
+	rel := containerRelPath(targetPath)
+
+	idmap, err := c.currentIdmap()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if r.Method != "GET" {
+		if rel == "" {
+			return BadRequest(fmt.Errorf("The container's root can't be changed"))
+		}
+
+		/* A state saved before the rootfs changed can't be restored */
+		if !c.c.Running() {
+			if err := c.clearState(); err != nil {
+				return InternalError(err)
+			}
+		}
+	}
+
+	dir, name, err := openContainerDir(rootfs, rel)
+	if err != nil {
+		return fileError(targetPath, err)
 	}
+	defer dir.Close()
 
 	switch r.Method {
 	case "GET":
-		return containerFileGet(r, p)
+		return containerFileGet(r, dir, name, idmap)
 	case "POST":
-		return containerFilePut(r, p, d.idMap, c.isPrivileged())
+		return containerFilePut(r, dir, name, idmap)
+	case "DELETE":
+		return containerFileDelete(r, dir, name)
 	default:
 		return NotFound
 	}
 }
 
-func containerFileGet(r *http.Request, path string) Response {
-	fi, err := os.Stat(path)
+// containerRelPath makes the path argument relative to the container's root.
+func containerRelPath(targetPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+targetPath), "/")
+}
+
+/*
+ * openContainerDir opens the directory holding the last component of rel,
+ * and returns it along with that component. The file API runs as root on
+ * the host, so no symlink of the container may be followed on the way (it
+ * would be resolved against the host's root): each component is opened
+ * from the one before it with O_NOFOLLOW, which fails on symlinks.
+ */
+func openContainerDir(rootfs string, rel string) (*os.File, string, error) {
+	fd, err := syscall.Open(rootfs, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
 	if err != nil {
-		return SmartError(err)
+		return nil, "", err
 	}
 
-	/*
-	 * Unfortunately, there's no portable way to do this:
-	 * https://groups.google.com/forum/#!topic/golang-nuts/tGYjYyrwsGM
-	 * https://groups.google.com/forum/#!topic/golang-nuts/ywS7xQYJkHY
-	 */
-	sb := fi.Sys().(*syscall.Stat_t)
-	headers := map[string]string{
-		"X-LXD-uid":  strconv.FormatUint(uint64(sb.Uid), 10),
-		"X-LXD-gid":  strconv.FormatUint(uint64(sb.Gid), 10),
-		"X-LXD-mode": fmt.Sprintf("%04o", fi.Mode()&os.ModePerm),
+	components := strings.Split(rel, "/")
+	for _, component := range components[:len(components)-1] {
+		next, err := syscall.Openat(fd, component, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(fd)
+		if err != nil {
+			return nil, "", err
+		}
+		fd = next
+	}
+
+	name := components[len(components)-1]
+	if name == "" {
+		name = "."
 	}
 
-	return FileResponse(r, path, filepath.Base(path), headers)
+	return os.NewFile(uintptr(fd), fdPath(fd)), name, nil
 }
 
-func containerFilePut(r *http.Request, p string, idmap *shared.Idmap, privileged bool) Response {
+/*
+ * fdPath is a path to what fd is open on. The kernel resolves it through
+ * the fd, so paths under it are as safe as openat() on the fd.
+ */
+func fdPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
 
-	uid, gid, mode, err := shared.ParseLXDFileHeaders(r.Header)
+/*
+ * openContainerFile opens name in dir without following it if it's a
+ * symlink, nor blocking on it if it's a FIFO.
+ */
+func openContainerFile(dir *os.File, name string, flags int, mode uint32) (*os.File, error) {
+	fd, err := syscall.Openat(int(dir.Fd()), name, flags|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, mode)
 	if err != nil {
-		return BadRequest(err)
+		return nil, err
 	}
 
-	if !privileged {
+	return os.NewFile(uintptr(fd), fdPath(fd)), nil
+}
+
+// fileError turns the errors of the file API into the matching response.
+func fileError(targetPath string, err error) Response {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
 
-		// map provided uid / gid to UID / GID range of the container
-		uid = int(idmap.Uidmin) + uid
-		gid = int(idmap.Gidmin) + gid
+	if lerr, ok := err.(*os.LinkError); ok {
+		err = lerr.Err
 	}
 
-	fileinfo, err := os.Stat(path.Dir(p))
-	if err != nil {
+	switch err {
+	case syscall.ENOENT:
+		return NotFound
+	case syscall.EEXIST:
+		return Conflict
+	case syscall.ELOOP, syscall.ENOTDIR:
+		return BadRequest(fmt.Errorf("%s goes through a symlink or a file", targetPath))
+	case syscall.EISDIR, syscall.ENOTEMPTY:
+		return BadRequest(fmt.Errorf("%s is a directory", targetPath))
+	default:
 		return SmartError(err)
 	}
+}
 
-	if !(fileinfo.IsDir()) {
-		return SmartError(os.ErrNotExist)
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsRegular():
+		return "file"
 	}
 
-	f, err := os.Create(p)
-	if err != nil {
-		return SmartError(err)
+	return "other"
+}
+
+/*
+ * fileEntry describes a file of the container, with its owner as seen from
+ * the container.
+ */
+func fileEntry(p string, fi os.FileInfo, idmap *containerIdmap) shared.ContainerFileEntry {
+	sb := fi.Sys().(*syscall.Stat_t)
+	entry := shared.ContainerFileEntry{
+		Name: fi.Name(),
+		Type: fileType(fi.Mode()),
+		Mode: uint32(sb.Mode & 07777),
+		Uid:  idmap.nsUid(int(sb.Uid)),
+		Gid:  idmap.nsGid(int(sb.Gid)),
+		Size: fi.Size(),
 	}
-	defer f.Close()
 
-	err = f.Chmod(mode)
-	if err != nil {
-		return SmartError(err)
+	if entry.Type == "symlink" {
+		entry.Target, _ = os.Readlink(p)
 	}
 
-	err = f.Chown(uid, gid)
+	return entry
+}
+
+/*
+ * containerFileGet returns the content of a regular file. For directories
+ * and symlinks, it returns the directory's entries or the symlink's target
+ * in a sync response. Either way, the X-LXD-* headers describe the file.
+ */
+func containerFileGet(r *http.Request, dir *os.File, name string, idmap *containerIdmap) Response {
+	targetPath := r.FormValue("path")
+
+	/* Not joined, as "/proc/self/fd/N" is a symlink but ".../N/." isn't */
+	p := dir.Name() + "/" + name
+
+	fi, err := os.Lstat(p)
 	if err != nil {
-		return SmartError(err)
+		return fileError(targetPath, err)
+	}
+
+	entry := fileEntry(p, fi, idmap)
+	headers := map[string]string{
+		"X-LXD-uid":  strconv.Itoa(entry.Uid),
+		"X-LXD-gid":  strconv.Itoa(entry.Gid),
+		"X-LXD-mode": fmt.Sprintf("%04o", entry.Mode),
+		"X-LXD-type": entry.Type,
+	}
+
+	switch entry.Type {
+	case "file":
+		f, err := openContainerFile(dir, name, syscall.O_RDONLY, 0)
+		if err != nil {
+			return fileError(targetPath, err)
+		}
+
+		/* It may have been replaced since the Lstat() */
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			f.Close()
+			return BadRequest(fmt.Errorf("%s changed while being read", targetPath))
+		}
+
+		return OpenFileResponse(r, f, filepath.Base(targetPath), headers)
+	case "symlink":
+		return SyncResponseHeaders(true, entry.Target, headers)
+	case "directory":
+		d, err := openContainerFile(dir, name, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			return fileError(targetPath, err)
+		}
+		defer d.Close()
+
+		infos, err := d.Readdir(-1)
+		if err != nil {
+			return SmartError(err)
+		}
+
+		entries := []shared.ContainerFileEntry{}
+		for _, info := range infos {
+			entries = append(entries, fileEntry(filepath.Join(d.Name(), info.Name()), info, idmap))
+		}
+
+		return SyncResponseHeaders(true, entries, headers)
+	default:
+		return BadRequest(fmt.Errorf("%s isn't a file, a directory or a symlink", targetPath))
 	}
+}
+
+/*
+ * containerFilePut creates (or replaces) a file, a directory or a symlink,
+ * depending on X-LXD-type. The body is the content of a file, or the target
+ * of a symlink. An existing directory only gets its owner and mode updated.
+ */
+func containerFilePut(r *http.Request, dir *os.File, name string, idmap *containerIdmap) Response {
+	targetPath := r.FormValue("path")
 
-	_, err = io.Copy(f, r.Body)
+	uid, gid, mode, err := shared.ParseLXDFileHeaders(r.Header)
 	if err != nil {
-		return InternalError(err)
+		return BadRequest(err)
+	}
+
+	// map provided uid / gid to UID / GID range of the container
+	uid = idmap.hostUid(uid)
+	gid = idmap.hostGid(gid)
+
+	/* The mode is sent as unix permission bits, setuid and co. included */
+	perm := uint32(mode) & 07777
+
+	switch r.Header.Get("X-LXD-type") {
+	case "", "file":
+		f, err := openContainerFile(dir, name, syscall.O_WRONLY|syscall.O_CREAT, perm)
+		if err == syscall.ELOOP {
+			/* A symlink is replaced, not written through */
+			if err := syscall.Unlinkat(int(dir.Fd()), name); err != nil {
+				return fileError(targetPath, err)
+			}
+
+			f, err = openContainerFile(dir, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, perm)
+		}
+
+		if err != nil {
+			return fileError(targetPath, err)
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return InternalError(err)
+		}
+
+		if !fi.Mode().IsRegular() {
+			return BadRequest(fmt.Errorf("%s isn't a regular file", targetPath))
+		}
+
+		if err := f.Truncate(0); err != nil {
+			return InternalError(err)
+		}
+
+		if err := f.Chown(uid, gid); err != nil {
+			return InternalError(err)
+		}
+
+		/* After the chown, which clears setuid and setgid */
+		if err := syscall.Fchmod(int(f.Fd()), perm); err != nil {
+			return InternalError(err)
+		}
+
+		_, err = io.Copy(f, r.Body)
+		if err != nil {
+			return InternalError(err)
+		}
+	case "directory":
+		err := syscall.Mkdirat(int(dir.Fd()), name, perm)
+		if err != nil && err != syscall.EEXIST {
+			return fileError(targetPath, err)
+		}
+
+		d, err := openContainerFile(dir, name, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err == syscall.ELOOP || err == syscall.ENOTDIR {
+			return Conflict
+		} else if err != nil {
+			return fileError(targetPath, err)
+		}
+		defer d.Close()
+
+		if err := d.Chown(uid, gid); err != nil {
+			return InternalError(err)
+		}
+
+		if err := syscall.Fchmod(int(d.Fd()), perm); err != nil {
+			return InternalError(err)
+		}
+	case "symlink":
+		target, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return InternalError(err)
+		}
+
+		if len(target) == 0 {
+			return BadRequest(fmt.Errorf("A symlink needs a target"))
+		}
+
+		err = syscall.Unlinkat(int(dir.Fd()), name)
+		if err != nil && err != syscall.ENOENT {
+			if err == syscall.EISDIR {
+				return Conflict
+			}
+
+			return fileError(targetPath, err)
+		}
+
+		p := filepath.Join(dir.Name(), name)
+		if err := os.Symlink(string(target), p); err != nil {
+			return fileError(targetPath, err)
+		}
+
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return InternalError(err)
+		}
+	default:
+		return BadRequest(fmt.Errorf("Unknown file type: %s", r.Header.Get("X-LXD-type")))
+	}
+
+	return EmptySyncResponse
+}
+
+// containerFileDelete removes a file, a symlink or an empty directory.
+func containerFileDelete(r *http.Request, dir *os.File, name string) Response {
+	if err := os.Remove(filepath.Join(dir.Name(), name)); err != nil {
+		return fileError(r.FormValue("path"), err)
 	}
 
 	return EmptySyncResponse
 }
 
-var containerFileCmd = Command{name: "containers/{name}/files", get: containerFileHandler, post: containerFileHandler}
+var containerFileCmd = Command{name: "containers/{name}/files", get: containerFileHandler, post: containerFileHandler, delete: containerFileHandler}
 
 func snapshotsDir(c *lxdContainer) string {
 	return shared.VarPath("lxc", c.name, "snapshots")
@@ -1751,7 +2701,12 @@ func snapshotPost(r *http.Request, c *lxdContainer, oldName string) Response {
 func snapshotDelete(d *Daemon, c *lxdContainer, name string) Response {
 	dbRemoveSnapshot(d, c.name, name)
 	dir := snapshotDir(c, name)
-	remove := func() error { return os.RemoveAll(dir) }
+	remove := func() error {
+		if shared.IsBtrfsSubvolume(dir) {
+			exec.Command("btrfs", "subvolume", "delete", dir).Run()
+		}
+		return os.RemoveAll(dir)
+	}
 	return AsyncResponse(shared.OperationWrap(remove), nil)
 }
 
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lxc/lxd/shared"
+)
+
+func TestContainerValidName(t *testing.T) {
+	for _, name := range []string{"foo", "foo-bar", ".foo", "foo.."} {
+		if err := containerValidName(name); err != nil {
+			t.Errorf("%q rejected: %s", name, err)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "foo/bar", "../foo"} {
+		if err := containerValidName(name); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+func TestContainerRelPath(t *testing.T) {
+	for in, out := range map[string]string{
+		"/etc/passwd":         "etc/passwd",
+		"etc/passwd":          "etc/passwd",
+		"../../../etc/shadow": "etc/shadow",
+		"/foo/../../bar/":     "bar",
+		"/":                   "",
+	} {
+		if rel := containerRelPath(in); rel != out {
+			t.Errorf("%q gave %q instead of %q", in, rel, out)
+		}
+	}
+}
+
+/*
+ * testFileRequest runs a file API request against rootfs, the way
+ * containerFileHandler does for a container.
+ */
+func testFileRequest(t *testing.T, method string, rootfs string, p string, ftype string, mode string, body string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, "/1.0/containers/c/files?path="+p, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("X-LXD-uid", "0")
+	r.Header.Set("X-LXD-gid", "0")
+	r.Header.Set("X-LXD-mode", mode)
+	r.Header.Set("X-LXD-type", ftype)
+
+	var resp Response
+	dir, name, err := openContainerDir(rootfs, containerRelPath(p))
+	if err != nil {
+		resp = fileError(p, err)
+	} else {
+		defer dir.Close()
+
+		switch method {
+		case "GET":
+			resp = containerFileGet(r, dir, name, nil)
+		case "POST":
+			resp = containerFilePut(r, dir, name, nil)
+		case "DELETE":
+			resp = containerFileDelete(r, dir, name)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := resp.Render(w); err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+func testFileRoots(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "lxd_files_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	host := filepath.Join(dir, "host")
+	for _, d := range []string{rootfs, host, filepath.Join(rootfs, "etc")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(host, "shadow"), []byte("secret"), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	/* Symlinks which only lead out of the container on the host */
+	for link, target := range map[string]string{"escape": host, "shadow": filepath.Join(host, "shadow")} {
+		if err := os.Symlink(target, filepath.Join(rootfs, link)); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	return rootfs, host, func() { os.RemoveAll(dir) }
+}
+
+func TestContainerFiles(t *testing.T) {
+	rootfs, _, cleanup := testFileRoots(t)
+	defer cleanup()
+
+	w := testFileRequest(t, "POST", rootfs, "/etc/foo", "file", "04755", "hello")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Pushing a file failed: %d %s", w.Code, w.Body)
+	}
+
+	w = testFileRequest(t, "GET", rootfs, "/etc/foo", "", "", "")
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("Bad content: %d %s", w.Code, w.Body)
+	}
+
+	if mode := w.Header().Get("X-LXD-mode"); mode != "4755" {
+		t.Errorf("Bad mode: %s", mode)
+	}
+
+	w = testFileRequest(t, "POST", rootfs, "/etc/foo", "file", "0644", "bye")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Replacing a file failed: %d %s", w.Code, w.Body)
+	}
+
+	w = testFileRequest(t, "GET", rootfs, "/etc/foo", "", "", "")
+	if w.Body.String() != "bye" || w.Header().Get("X-LXD-mode") != "0644" {
+		t.Errorf("The file wasn't replaced: %s %s", w.Header().Get("X-LXD-mode"), w.Body)
+	}
+
+	w = testFileRequest(t, "POST", rootfs, "/etc/dir", "directory", "01777", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Creating a directory failed: %d %s", w.Code, w.Body)
+	}
+
+	w = testFileRequest(t, "POST", rootfs, "/etc/link", "symlink", "0777", "foo")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Creating a symlink failed: %d %s", w.Code, w.Body)
+	}
+
+	w = testFileRequest(t, "GET", rootfs, "/etc", "", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Listing failed: %d %s", w.Code, w.Body)
+	}
+
+	resp := struct {
+		Metadata []shared.ContainerFileEntry `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := map[string]shared.ContainerFileEntry{}
+	for _, entry := range resp.Metadata {
+		entries[entry.Name] = entry
+	}
+
+	if e := entries["dir"]; e.Type != "directory" || e.Mode != 01777 {
+		t.Errorf("Bad directory entry: %+v", e)
+	}
+
+	if e := entries["link"]; e.Type != "symlink" || e.Target != "foo" {
+		t.Errorf("Bad symlink entry: %+v", e)
+	}
+
+	w = testFileRequest(t, "GET", rootfs, "/", "", "", "")
+	if w.Code != http.StatusOK || w.Header().Get("X-LXD-type") != "directory" {
+		t.Errorf("Listing the root failed: %d %s", w.Code, w.Header().Get("X-LXD-type"))
+	}
+
+	for _, p := range []string{"/etc/link", "/etc/dir", "/etc/foo"} {
+		if w := testFileRequest(t, "DELETE", rootfs, p, "", "", ""); w.Code != http.StatusOK {
+			t.Errorf("Removing %s failed: %d %s", p, w.Code, w.Body)
+		}
+	}
+
+	if w := testFileRequest(t, "DELETE", rootfs, "/etc/foo", "", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Removing a missing file gave %d", w.Code)
+	}
+}
+
+func TestContainerFilesSymlinks(t *testing.T) {
+	rootfs, host, cleanup := testFileRoots(t)
+	defer cleanup()
+
+	for _, req := range [][3]string{
+		{"GET", "/escape/shadow", ""},
+		{"GET", "/shadow", ""},
+		{"POST", "/escape/foo", "file"},
+		{"POST", "/escape/dir", "directory"},
+		{"POST", "/escape/link", "symlink"},
+		{"DELETE", "/escape/shadow", ""},
+	} {
+		w := testFileRequest(t, req[0], rootfs, req[1], req[2], "0644", "pwned")
+		if req[0] == "GET" && req[1] == "/shadow" {
+			/* The symlink itself can be read, not what it leads to */
+			if strings.Contains(w.Body.String(), "secret") {
+				t.Errorf("%s %s went through the symlink", req[0], req[1])
+			}
+			continue
+		}
+
+		if w.Code == http.StatusOK {
+			t.Errorf("%s %s went through the symlink", req[0], req[1])
+		}
+	}
+
+	/* Pushing over the symlink replaces it */
+	w := testFileRequest(t, "POST", rootfs, "/shadow", "file", "0644", "pwned")
+	if w.Code != http.StatusOK {
+		t.Errorf("Replacing a symlink failed: %d %s", w.Code, w.Body)
+	}
+
+	if fi, err := os.Lstat(filepath.Join(rootfs, "shadow")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("The symlink wasn't replaced")
+	}
+
+	infos, err := ioutil.ReadDir(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 1 {
+		t.Errorf("Files were created on the host: %d", len(infos))
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(host, "shadow"))
+	if err != nil || string(content) != "secret" {
+		t.Errorf("The host's file was changed: %s", content)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lxc/lxd"
@@ -171,6 +172,10 @@ func (d *Daemon) createCmd(version string, c Command) {
 	}
 
 	d.mux.HandleFunc(uri, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		w = sw
+		defer func() { httpRecord(r.Method, uri, sw.code, time.Since(start)) }()
 
 		if d.isTrustedClient(r) {
 			shared.Debugf("handling %s %s", r.Method, r.URL.RequestURI())
@@ -244,6 +249,11 @@ func StartDaemon(listenAddr string) (*Daemon, error) {
 		return nil, err
 	}
 
+	err = setupSharedMounts()
+	if err != nil {
+		return nil, err
+	}
+
 	certf, keyf, err := readMyCert()
 	if err != nil {
 		return nil, err
@@ -353,6 +363,12 @@ func StartDaemon(listenAddr string) (*Daemon, error) {
 		return nil
 	})
 
+	go func() {
+		if err := containersAutostart(d); err != nil {
+			shared.Logf("Failed to autostart containers: %s", err)
+		}
+	}()
+
 	return d, nil
 }
 
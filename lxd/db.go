@@ -661,6 +661,30 @@ func dbGetProfiles(d *Daemon, c *lxdContainer) ([]string, error) {
 	return profiles, nil
 }
 
+func dbGetProfileContainers(d *Daemon, profile string) ([]string, error) {
+	q := `SELECT containers.name FROM containers JOIN containers_profiles
+		ON containers.id=containers_profiles.container_id
+		JOIN profiles ON containers_profiles.profile_id=profiles.id
+		WHERE profiles.name=? AND containers.type=?`
+	var name string
+	inargs := []interface{}{profile, cTypeRegular}
+	outfmt := []interface{}{name}
+	results, err := shared.DbQueryScan(d.db, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []string
+
+	for _, r := range results {
+		name = r[0].(string)
+
+		containers = append(containers, name)
+	}
+
+	return containers, nil
+}
+
 func dbGetDeviceConfig(db *sql.DB, id int, isprofile bool) (shared.Device, error) {
 	var q string
 	if isprofile {
@@ -1,70 +1,1215 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/lxc/lxd/shared"
 )
 
-func DeviceToLxc(d shared.Device) ([][]string, error) {
+func DeviceToLxc(c *lxdContainer, d shared.Device) ([][]string, error) {
 	switch d["type"] {
-	case "unix-char":
-		return nil, fmt.Errorf("Not implemented")
-	case "unix-block":
-		return nil, fmt.Errorf("Not implemented")
+	case "unix-char", "unix-block":
+		rule, err := unixDeviceCgroupRule(d)
+		if err != nil {
+			return nil, err
+		}
+
+		/*
+		 * The node itself is created on the host by setupUnixDevices
+		 * and bind mounted, as unprivileged containers can't use nodes
+		 * they create themselves.
+		 */
+		return [][]string{
+			[]string{"lxc.cgroup.devices.allow", rule},
+			[]string{"lxc.mount.entry", fmt.Sprintf("%s %s none bind,create=file", unixDevicePath(c, d), unixDeviceRelPath(d))},
+		}, nil
 	case "nic":
-		if d["nictype"] != "bridged" && d["nictype"] != "" {
+		var lines [][]string
+
+		switch d["nictype"] {
+		case "", "bridged":
+			lines = append(lines, []string{"lxc.network.type", "veth"})
+			if d["parent"] != "" {
+				lines = append(lines, []string{"lxc.network.link", d["parent"]})
+			}
+		case "p2p":
+			/* A veth pair whose host side isn't added to any bridge */
+			lines = append(lines, []string{"lxc.network.type", "veth"})
+		case "macvlan":
+			if d["parent"] == "" {
+				return nil, fmt.Errorf("Missing parent for macvlan nic")
+			}
+			lines = append(lines, []string{"lxc.network.type", "macvlan"}, []string{"lxc.network.link", d["parent"]})
+			if d["macvlan.mode"] != "" {
+				lines = append(lines, []string{"lxc.network.macvlan.mode", d["macvlan.mode"]})
+			}
+		case "physical":
+			if d["parent"] == "" {
+				return nil, fmt.Errorf("Missing parent for physical nic")
+			}
+			lines = append(lines, []string{"lxc.network.type", "phys"}, []string{"lxc.network.link", d["parent"]})
+		default:
 			return nil, fmt.Errorf("Bad nic type: %s\n", d["nictype"])
 		}
-		var l1 = []string{"lxc.network.type", "veth"}
-		var lines = [][]string{l1}
-		var l2 []string
+
+		if d["host_name"] != "" {
+			if !nicHasHostSide(d) {
+				return nil, fmt.Errorf("host_name only applies to bridged and p2p nics")
+			}
+			lines = append(lines, []string{"lxc.network.veth.pair", d["host_name"]})
+		}
 		if d["hwaddr"] != "" {
-			l2 = []string{"lxc.network.hwaddr", d["hwaddr"]}
-			lines = append(lines, l2)
+			lines = append(lines, []string{"lxc.network.hwaddr", d["hwaddr"]})
 		}
 		if d["mtu"] != "" {
-			l2 = []string{"lxc.network.mtu", d["mtu"]}
-			lines = append(lines, l2)
-		}
-		if d["parent"] != "" {
-			l2 = []string{"lxc.network.link", d["parent"]}
-			lines = append(lines, l2)
+			lines = append(lines, []string{"lxc.network.mtu", d["mtu"]})
 		}
 		if d["name"] != "" {
-			l2 = []string{"lxc.network.name", d["name"]}
-			lines = append(lines, l2)
+			lines = append(lines, []string{"lxc.network.name", d["name"]})
 		}
 		return lines, nil
 	case "disk":
-		var p string
-		if d["path"] == "/" || d["path"] == "" {
-			p = ""
-		} else if d["path"][0:1] == "/" {
-			p = d["path"][1:]
-		} else {
-			p = d["path"]
-		}
-		/* TODO - check whether source is a disk, loopback, btrfs subvol, etc */
-		/* for now we only handle directory bind mounts */
-		source := d["source"]
-		opts := "bind"
-		if shared.IsDir(source) {
-			opts = fmt.Sprintf("%s,create=dir", opts)
-		} else {
-			opts = fmt.Sprintf("%s,create=file", opts)
-		}
-		if d["readonly"] == "1" || d["readonly"] == "true" {
-			opts = fmt.Sprintf("%s,ro", opts)
-		}
-		if d["optional"] == "1" || d["optinal"] == "true" {
-			opts = fmt.Sprintf("%s,optional", opts)
-		}
-		l := []string{"lxc.mount.entry", fmt.Sprintf("%s %s none %s", source, p, opts)}
-		return [][]string{l}, nil
+		/*
+		 * Telling how to mount the source and which block device to
+		 * throttle means probing the host, so the mount entry and the
+		 * limits are only added by setupDevices, on start.
+		 */
+		return nil, nil
 	case "none":
 		return nil, nil
 	default:
 		return nil, fmt.Errorf("Bad device type")
 	}
 }
+
+func unixDeviceRelPath(d shared.Device) string {
+	return strings.TrimLeft(d["path"], "/")
+}
+
+// unixDevicePath returns the path of the host side node of a unix-char or
+// unix-block device.
+func unixDevicePath(c *lxdContainer, d shared.Device) string {
+	name := strings.Replace(unixDeviceRelPath(d), "/", "-", -1)
+	return shared.VarPath("devices", c.name, fmt.Sprintf("unix.%s", name))
+}
+
+/*
+ * unixDeviceNumbers returns the major and minor numbers of a unix-char or
+ * unix-block device. Those which aren't set are taken from the node at the
+ * same path on the host.
+ */
+func unixDeviceNumbers(d shared.Device) (int, int, error) {
+	if d["path"] == "" {
+		return 0, 0, fmt.Errorf("Missing path for %s device", d["type"])
+	}
+
+	if d["major"] != "" && d["minor"] != "" {
+		major, err := strconv.Atoi(d["major"])
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid major number: %s", d["major"])
+		}
+
+		minor, err := strconv.Atoi(d["minor"])
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid minor number: %s", d["minor"])
+		}
+
+		return major, minor, nil
+	}
+
+	hostPath := fmt.Sprintf("/%s", unixDeviceRelPath(d))
+	stat := syscall.Stat_t{}
+	if err := syscall.Stat(hostPath, &stat); err != nil {
+		return 0, 0, fmt.Errorf("Couldn't find the major and minor numbers of %s: %s", hostPath, err)
+	}
+
+	format := uint32(syscall.S_IFCHR)
+	if d["type"] == "unix-block" {
+		format = syscall.S_IFBLK
+	}
+
+	if stat.Mode&syscall.S_IFMT != format {
+		return 0, 0, fmt.Errorf("%s isn't a %s device", hostPath, d["type"])
+	}
+
+	major := int(devMajor(uint64(stat.Rdev)))
+	minor := int(devMinor(uint64(stat.Rdev)))
+
+	var err error
+	if d["major"] != "" {
+		if major, err = strconv.Atoi(d["major"]); err != nil {
+			return 0, 0, fmt.Errorf("Invalid major number: %s", d["major"])
+		}
+	}
+
+	if d["minor"] != "" {
+		if minor, err = strconv.Atoi(d["minor"]); err != nil {
+			return 0, 0, fmt.Errorf("Invalid minor number: %s", d["minor"])
+		}
+	}
+
+	return major, minor, nil
+}
+
+// unixDeviceCgroupRule returns the devices cgroup rule giving access to a
+// unix-char or unix-block device.
+func unixDeviceCgroupRule(d shared.Device) (string, error) {
+	major, minor, err := unixDeviceNumbers(d)
+	if err != nil {
+		return "", err
+	}
+
+	t := "c"
+	if d["type"] == "unix-block" {
+		t = "b"
+	}
+
+	return fmt.Sprintf("%s %d:%d rwm", t, major, minor), nil
+}
+
+/*
+ * createUnixDevice creates the host side node of a unix-char or unix-block
+ * device, owned by the uid and gid the device's uid and gid map to in the
+ * container.
+ */
+func createUnixDevice(c *lxdContainer, d shared.Device) error {
+	major, minor, err := unixDeviceNumbers(d)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0660)
+	if d["mode"] != "" {
+		m, err := strconv.ParseInt(d["mode"], 8, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid mode: %s", d["mode"])
+		}
+		mode = os.FileMode(m)
+	}
+
+	uid := 0
+	if d["uid"] != "" {
+		if uid, err = strconv.Atoi(d["uid"]); err != nil {
+			return fmt.Errorf("Invalid uid: %s", d["uid"])
+		}
+	}
+
+	gid := 0
+	if d["gid"] != "" {
+		if gid, err = strconv.Atoi(d["gid"]); err != nil {
+			return fmt.Errorf("Invalid gid: %s", d["gid"])
+		}
+	}
+
+	uid = c.idmap.hostUid(uid)
+	gid = c.idmap.hostGid(gid)
+
+	format := uint32(syscall.S_IFCHR)
+	if d["type"] == "unix-block" {
+		format = syscall.S_IFBLK
+	}
+
+	if err := os.MkdirAll(shared.VarPath("devices", c.name), 0711); err != nil {
+		return err
+	}
+
+	p := unixDevicePath(c, d)
+	os.Remove(p)
+
+	dev := (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+	if err := syscall.Mknod(p, format|uint32(mode.Perm()), dev); err != nil {
+		return fmt.Errorf("Failed to create device %s: %s", p, err)
+	}
+
+	/* mknod is subject to the umask */
+	if err := os.Chmod(p, mode); err != nil {
+		return err
+	}
+
+	return os.Chown(p, uid, gid)
+}
+
+/*
+ * setupDevices prepares what the container's devices need on the host
+ * before it starts: the nodes of the unix-char and unix-block devices and
+ * the mounts of the disks backed by block devices or image files.
+ */
+func (c *lxdContainer) setupDevices() error {
+	/* Disks removed since the container last ran may still be mounted */
+	keep := map[string]bool{}
+	for _, d := range c.devices {
+		if d["type"] == "disk" {
+			keep[diskDevicePath(c, d)] = true
+		}
+	}
+	unmountDiskSources(c.name, keep)
+
+	for name, d := range c.devices {
+		var err error
+
+		switch d["type"] {
+		case "unix-char", "unix-block":
+			err = createUnixDevice(c, d)
+		case "disk":
+			err = mountDiskSource(c, d)
+			if entry := diskMountEntry(c, d); err == nil && entry != "" {
+				err = c.c.SetConfigItem("lxc.mount.entry", entry)
+			}
+			if err == nil {
+				err = c.setupDiskLimits(d)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed setting up device %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setupDiskLimits sets the blkio limits of a disk for the container's start.
+func (c *lxdContainer) setupDiskLimits(d shared.Device) error {
+	items, err := diskLimitItems(c, d, false)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := c.c.SetConfigItem(fmt.Sprintf("lxc.cgroup.%s", item[0]), item[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * unmountDiskSources unmounts the disk sources mountDiskSource mounted for
+ * the named container, except those mounted at the paths in keep.
+ */
+func unmountDiskSources(name string, keep map[string]bool) {
+	p := shared.VarPath("devices", name)
+
+	ents, err := ioutil.ReadDir(p)
+	if err != nil {
+		return
+	}
+
+	for _, ent := range ents {
+		target := path.Join(p, ent.Name())
+		if !strings.HasPrefix(ent.Name(), "disk.") || keep[target] || !isMountPoint(target) {
+			continue
+		}
+
+		if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil {
+			shared.Debugf("Error unmounting %s: %s\n", target, err)
+			continue
+		}
+		os.Remove(target)
+	}
+}
+
+// removeDevicesPath cleans up what setupDevices created for the named
+// container.
+func removeDevicesPath(name string) {
+	p := shared.VarPath("devices", name)
+
+	ents, err := ioutil.ReadDir(p)
+	if err == nil {
+		for _, ent := range ents {
+			if isMountPoint(path.Join(p, ent.Name())) {
+				syscall.Unmount(path.Join(p, ent.Name()), syscall.MNT_DETACH)
+			}
+		}
+	}
+
+	if err := os.RemoveAll(p); err != nil {
+		shared.Debugf("Error cleaning up %s: %s\n", p, err)
+	}
+}
+
+// diskDevicePath returns where the source of a disk backed by a block
+// device or an image file is mounted on the host.
+func diskDevicePath(c *lxdContainer, d shared.Device) string {
+	name := strings.Replace(strings.TrimLeft(d["path"], "/"), "/", "-", -1)
+	return shared.VarPath("devices", c.name, fmt.Sprintf("disk.%s", name))
+}
+
+/*
+ * diskMountEntry returns the lxc.mount.entry of a disk other than the
+ * rootfs, or "" if there's nothing to mount. Sources which have to be
+ * mounted on the host first must have been mounted by mountDiskSource.
+ */
+func diskMountEntry(c *lxdContainer, d shared.Device) string {
+	if d["path"] == "/" || d["path"] == "" {
+		return ""
+	}
+	p := strings.TrimLeft(d["path"], "/")
+
+	/* A missing source makes the container fail to start */
+	source := d["source"]
+	if !shared.PathExists(source) && isTrue(d["optional"]) {
+		/* Nothing to mount */
+		return ""
+	}
+
+	opts := "bind"
+	if isTrue(d["recursive"]) {
+		opts = "rbind"
+	}
+
+	if isMountPoint(diskDevicePath(c, d)) {
+		/* Mounted on the host by mountDiskSource, then bind mounted in */
+		source = diskDevicePath(c, d)
+		opts = fmt.Sprintf("%s,create=dir", opts)
+	} else if shared.IsDir(source) {
+		opts = fmt.Sprintf("%s,create=dir", opts)
+	} else {
+		opts = fmt.Sprintf("%s,create=file", opts)
+	}
+	if isTrue(d["readonly"]) {
+		opts = fmt.Sprintf("%s,ro", opts)
+	}
+	if isTrue(d["optional"]) {
+		opts = fmt.Sprintf("%s,optional", opts)
+	}
+	if d["propagation"] != "" {
+		opts = fmt.Sprintf("%s,%s", opts, d["propagation"])
+	}
+	return fmt.Sprintf("%s %s none %s 0 0", source, p, opts)
+}
+
+func diskFsType(source string) (string, error) {
+	output, err := exec.Command("blkid", "-s", "TYPE", "-o", "value", source).Output()
+	if err != nil {
+		return "", fmt.Errorf("Couldn't detect the filesystem of %s", source)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+/*
+ * diskNeedsMount tells whether the source of a disk has to be mounted on
+ * the host before being bind mounted in the container, which is the case
+ * for block devices and for files containing a filesystem. Directories,
+ * including btrfs subvolumes, and other files are bind mounted directly.
+ */
+func diskNeedsMount(d shared.Device) (bool, error) {
+	if d["path"] == "/" || d["path"] == "" {
+		return false, nil
+	}
+
+	stat := syscall.Stat_t{}
+	if err := syscall.Stat(d["source"], &stat); err != nil {
+		return false, err
+	}
+
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		return true, nil
+	case syscall.S_IFREG:
+		_, err := diskFsType(d["source"])
+		return err == nil, nil
+	}
+
+	return false, nil
+}
+
+/*
+ * mountDiskSource mounts the source of a disk backed by a block device or
+ * an image file, looping the latter, at diskDevicePath. A source which is
+ * already mounted there is left alone, while one the device doesn't use
+ * anymore is replaced.
+ */
+func mountDiskSource(c *lxdContainer, d shared.Device) error {
+	if !shared.PathExists(d["source"]) {
+		if isTrue(d["optional"]) {
+			return nil
+		}
+
+		return fmt.Errorf("Source %s doesn't exist", d["source"])
+	}
+
+	mounted, err := diskNeedsMount(d)
+	if err != nil || !mounted {
+		return err
+	}
+
+	target := diskDevicePath(c, d)
+	if isMountPoint(target) {
+		if diskMountedFrom(target, d["source"]) {
+			return nil
+		}
+
+		if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(target, 0711); err != nil {
+		return err
+	}
+
+	fstype, err := diskFsType(d["source"])
+	if err != nil {
+		return err
+	}
+
+	opts := "rw"
+	if isTrue(d["readonly"]) {
+		opts = "ro"
+	}
+
+	if !isBlockDevice(d["source"]) {
+		opts = fmt.Sprintf("%s,loop", opts)
+	}
+
+	output, err := exec.Command("mount", "-t", fstype, "-o", opts, d["source"], target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to mount %s: %s", d["source"], strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+var diskPropagationFlags = map[string]uintptr{
+	"private":     syscall.MS_PRIVATE,
+	"shared":      syscall.MS_SHARED,
+	"slave":       syscall.MS_SLAVE,
+	"unbindable":  syscall.MS_UNBINDABLE,
+	"rprivate":    syscall.MS_PRIVATE | syscall.MS_REC,
+	"rshared":     syscall.MS_SHARED | syscall.MS_REC,
+	"rslave":      syscall.MS_SLAVE | syscall.MS_REC,
+	"runbindable": syscall.MS_UNBINDABLE | syscall.MS_REC,
+}
+
+// attachDisk mounts a disk in the running container.
+func (c *lxdContainer) attachDisk(d shared.Device) error {
+	if d["path"] == "/" || d["path"] == "" {
+		return fmt.Errorf("The root disk can't be changed while the container is running")
+	}
+
+	if !shared.PathExists(d["source"]) && isTrue(d["optional"]) {
+		return nil
+	}
+
+	if err := mountDiskSource(c, d); err != nil {
+		return err
+	}
+
+	source := d["source"]
+	if mounted, _ := diskNeedsMount(d); mounted {
+		source = diskDevicePath(c, d)
+	}
+
+	flags := diskPropagationFlags[d["propagation"]]
+	if isTrue(d["recursive"]) {
+		flags |= syscall.MS_REC
+	}
+	if isTrue(d["readonly"]) {
+		flags |= syscall.MS_RDONLY
+	}
+
+	return c.mountInto(source, fmt.Sprintf("/%s", strings.TrimLeft(d["path"], "/")), flags)
+}
+
+// detachDisk unmounts a disk from the running container.
+func (c *lxdContainer) detachDisk(d shared.Device) error {
+	if d["path"] == "/" || d["path"] == "" {
+		return fmt.Errorf("The root disk can't be changed while the container is running")
+	}
+
+	target := fmt.Sprintf("/%s", strings.TrimLeft(d["path"], "/"))
+	if err := c.unmountFrom(target); err != nil {
+		if !shared.PathExists(d["source"]) && isTrue(d["optional"]) {
+			/* It was never mounted */
+			return nil
+		}
+		return err
+	}
+
+	hostPath := diskDevicePath(c, d)
+	if isMountPoint(hostPath) {
+		if err := syscall.Unmount(hostPath, syscall.MNT_DETACH); err != nil {
+			return err
+		}
+		os.Remove(hostPath)
+	}
+
+	return nil
+}
+
+func isBlockDevice(p string) bool {
+	stat := syscall.Stat_t{}
+	if err := syscall.Stat(p, &stat); err != nil {
+		return false
+	}
+
+	return stat.Mode&syscall.S_IFMT == syscall.S_IFBLK
+}
+
+/*
+ * attachUnixDevice makes a unix-char or unix-block device available to the
+ * running container, allowing it in the devices cgroup and mounting its
+ * node at the configured path.
+ */
+func (c *lxdContainer) attachUnixDevice(d shared.Device) error {
+	rule, err := unixDeviceCgroupRule(d)
+	if err != nil {
+		return err
+	}
+
+	if err := createUnixDevice(c, d); err != nil {
+		return err
+	}
+
+	if err := c.c.SetCgroupItem("devices.allow", rule); err != nil {
+		return err
+	}
+
+	return c.mountInto(unixDevicePath(c, d), fmt.Sprintf("/%s", unixDeviceRelPath(d)), 0)
+}
+
+// detachUnixDevice removes a unix-char or unix-block device from the running
+// container.
+func (c *lxdContainer) detachUnixDevice(d shared.Device) error {
+	if err := c.unmountFrom(fmt.Sprintf("/%s", unixDeviceRelPath(d))); err != nil {
+		return err
+	}
+
+	rule, err := unixDeviceCgroupRule(d)
+	if err == nil {
+		if err := c.c.SetCgroupItem("devices.deny", rule); err != nil {
+			return err
+		}
+	}
+
+	os.Remove(unixDevicePath(c, d))
+	return nil
+}
+
+func devMajor(dev uint64) uint64 {
+	return (dev >> 8) & 0xfff
+}
+
+func devMinor(dev uint64) uint64 {
+	return (dev & 0xff) | ((dev >> 12) & 0xfff00)
+}
+
+/*
+ * blockDeviceNumbers returns the "major:minor" of the disk backing path,
+ * which is what the blkio throttling rules are keyed on. path may either be
+ * a block device or a file or directory on a mounted filesystem.
+ */
+func blockDeviceNumbers(p string) (string, error) {
+	stat := syscall.Stat_t{}
+	if err := syscall.Stat(p, &stat); err != nil {
+		return "", err
+	}
+
+	var dev uint64
+	if stat.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+		dev = uint64(stat.Rdev)
+	} else {
+		dev = uint64(stat.Dev)
+	}
+
+	numbers := fmt.Sprintf("%d:%d", devMajor(dev), devMinor(dev))
+
+	if devMajor(dev) == 0 {
+		/*
+		 * Filesystems like btrfs use anonymous device numbers, so look
+		 * up the device the filesystem was mounted from instead.
+		 */
+		source, err := mountSourceByNumbers(numbers)
+		if err != nil {
+			return "", err
+		}
+
+		if err := syscall.Stat(source, &stat); err != nil {
+			return "", err
+		}
+
+		if stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+			return "", fmt.Errorf("%s isn't backed by a block device", p)
+		}
+
+		dev = uint64(stat.Rdev)
+		numbers = fmt.Sprintf("%d:%d", devMajor(dev), devMinor(dev))
+	}
+
+	/* Throttling only applies to whole disks, not to partitions */
+	sysPath := fmt.Sprintf("/sys/dev/block/%s", numbers)
+	if shared.PathExists(path.Join(sysPath, "partition")) {
+		content, err := ioutil.ReadFile(path.Join(sysPath, "..", "dev"))
+		if err != nil {
+			return "", err
+		}
+
+		numbers = strings.TrimSpace(string(content))
+	}
+
+	return numbers, nil
+}
+
+func mountSourceByNumbers(numbers string) (string, error) {
+	source, err := mountSource(2, numbers)
+	if err == nil && source == "" {
+		err = fmt.Errorf("Couldn't find the mount for device %s", numbers)
+	}
+
+	return source, err
+}
+
+/*
+ * mountSource returns the source of the last mount whose field of
+ * /proc/self/mountinfo at index field is value, or "" if there's none.
+ */
+func mountSource(field int, value string) (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	source := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		/*
+		 * 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		 * The optional fields end with a "-", followed by the
+		 * filesystem type and the mount source.
+		 */
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= field || fields[field] != value {
+			continue
+		}
+
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) {
+				source = fields[i+2]
+				break
+			}
+		}
+	}
+
+	return source, scanner.Err()
+}
+
+/*
+ * diskMountedFrom tells whether what's mounted at target is source, seeing
+ * through the loop devices image files are mounted with.
+ */
+func diskMountedFrom(target string, source string) bool {
+	mounted, err := mountSource(4, target)
+	if err != nil || mounted == "" {
+		return false
+	}
+
+	if strings.HasPrefix(mounted, "/dev/loop") {
+		backing, err := ioutil.ReadFile(fmt.Sprintf("/sys/block/%s/loop/backing_file", path.Base(mounted)))
+		if err == nil {
+			mounted = strings.TrimSpace(string(backing))
+		}
+	}
+
+	if resolved, err := filepath.EvalSymlinks(source); err == nil {
+		source = resolved
+	}
+
+	return mounted == source
+}
+
+/*
+ * diskLimitItems returns the blkio cgroup items (without the "lxc.cgroup."
+ * prefix) implementing the limits.read and limits.write keys of a disk
+ * device. Limits are either a rate in bytes ("10MB") or a number of
+ * operations per second ("100iops").
+ *
+ * When live is true, the limits which aren't set are reset too.
+ */
+func diskLimitItems(c *lxdContainer, d shared.Device, live bool) ([][]string, error) {
+	if d["limits.read"] == "" && d["limits.write"] == "" && !live {
+		return nil, nil
+	}
+
+	source := d["source"]
+	if d["path"] == "/" || d["path"] == "" {
+		source = shared.VarPath("lxc", c.name, "rootfs")
+	}
+
+	numbers, err := blockDeviceNumbers(source)
+	if err != nil {
+		if d["limits.read"] == "" && d["limits.write"] == "" {
+			/* Nothing to reset on a device we can't throttle */
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Unable to find the block device for %s: %s", source, err)
+	}
+
+	if !shared.PathExists(fmt.Sprintf("%s/blkio/blkio.throttle.read_bps_device", CGROUP_PATH)) {
+		if d["limits.read"] == "" && d["limits.write"] == "" {
+			/* Without throttling support, no limits were ever set */
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Disk limits require blkio throttling support in the kernel")
+	}
+
+	items := [][]string{}
+	for _, direction := range []string{"read", "write"} {
+		bps, iops, err := shared.ParseDiskLimit(d[fmt.Sprintf("limits.%s", direction)])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for limits.%s: %s", direction, err)
+		}
+
+		/* A limit of 0 removes the rule */
+		if bps > 0 || live {
+			items = append(items, []string{fmt.Sprintf("blkio.throttle.%s_bps_device", direction), fmt.Sprintf("%s %d", numbers, bps)})
+		}
+
+		if iops > 0 || live {
+			items = append(items, []string{fmt.Sprintf("blkio.throttle.%s_iops_device", direction), fmt.Sprintf("%s %d", numbers, iops)})
+		}
+	}
+
+	return items, nil
+}
+
+// nicHasHostSide tells whether a nic is a veth pair, so has a host side
+// interface, as opposed to macvlan and physical nics.
+func nicHasHostSide(d shared.Device) bool {
+	switch d["nictype"] {
+	case "", "bridged", "p2p":
+		return true
+	}
+
+	return false
+}
+
+func nicRun(args ...string) error {
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to run %s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// nicNetnsRun runs ip with the given arguments in the network namespace of
+// the running container.
+func nicNetnsRun(c *lxdContainer, args ...string) (string, error) {
+	cmd := []string{"-t", fmt.Sprintf("%d", c.c.InitPid()), "-n", "ip"}
+	output, err := exec.Command("nsenter", append(cmd, args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+
+	return string(output), nil
+}
+
+/*
+ * nicContainerName returns the name of a nic inside the running container,
+ * matching it on its hardware address when the device doesn't set one.
+ */
+func nicContainerName(c *lxdContainer, d shared.Device) (string, error) {
+	if d["name"] != "" {
+		return d["name"], nil
+	}
+
+	output, err := nicNetnsRun(c, "-o", "link", "show")
+	if err != nil {
+		return "", err
+	}
+
+	/* 2: eth0@if5: <BROADCAST,...> mtu 1500 ... link/ether 00:16:3e:... brd ... */
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "link/ether" && i+1 < len(fields) && d["hwaddr"] != "" && strings.EqualFold(fields[i+1], d["hwaddr"]) {
+				return strings.SplitN(strings.TrimSuffix(fields[1], ":"), "@", 2)[0], nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("Couldn't find the interface with address %s in the container", d["hwaddr"])
+}
+
+// nicFreeName returns the first ethN name not used in the running container.
+func nicFreeName(c *lxdContainer) (string, error) {
+	ifaces, err := c.c.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	used := map[string]bool{}
+	for _, iface := range ifaces {
+		used[iface] = true
+	}
+
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("eth%d", i)
+		if !used[name] {
+			return name, nil
+		}
+	}
+}
+
+/*
+ * attachNic adds a nic to the running container: veths are created with
+ * their host side added to the parent bridge (if any), macvlans on top of
+ * their parent, then moved into the container's network namespace along
+ * with physical nics.
+ */
+func (c *lxdContainer) attachNic(d shared.Device) error {
+	name := d["name"]
+	if name == "" {
+		var err error
+		name, err = nicFreeName(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	var tmpName string
+	if d["nictype"] == "physical" {
+		tmpName = d["parent"]
+	} else {
+		tmpName, err = GenerateMacAddr("lxdxxxxxxxx")
+		if err != nil {
+			return err
+		}
+	}
+
+	switch d["nictype"] {
+	case "", "bridged", "p2p":
+		hostName := d["host_name"]
+		if hostName == "" {
+			hostName, err = GenerateMacAddr("vethxxxxxxxx")
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := nicRun("ip", "link", "add", hostName, "type", "veth", "peer", "name", tmpName); err != nil {
+			return err
+		}
+
+		if d["nictype"] != "p2p" && d["parent"] != "" {
+			if err := nicRun("ip", "link", "set", hostName, "master", d["parent"]); err != nil {
+				exec.Command("ip", "link", "del", hostName).Run()
+				return err
+			}
+		}
+
+		if d["mtu"] != "" {
+			if err := nicRun("ip", "link", "set", hostName, "mtu", d["mtu"]); err != nil {
+				exec.Command("ip", "link", "del", hostName).Run()
+				return err
+			}
+		}
+
+		if err := nicRun("ip", "link", "set", hostName, "up"); err != nil {
+			exec.Command("ip", "link", "del", hostName).Run()
+			return err
+		}
+	case "macvlan":
+		mode := d["macvlan.mode"]
+		if mode == "" {
+			mode = "private"
+		}
+
+		if err := nicRun("ip", "link", "add", tmpName, "link", d["parent"], "type", "macvlan", "mode", mode); err != nil {
+			return err
+		}
+	case "physical":
+	default:
+		return fmt.Errorf("Bad nic type: %s", d["nictype"])
+	}
+
+	/* Deleting either side of a veth pair deletes both */
+	cleanup := func() {
+		if d["nictype"] != "physical" {
+			exec.Command("ip", "link", "del", tmpName).Run()
+		}
+	}
+
+	if d["hwaddr"] != "" {
+		if err := nicRun("ip", "link", "set", tmpName, "address", d["hwaddr"]); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	if d["mtu"] != "" {
+		if err := nicRun("ip", "link", "set", tmpName, "mtu", d["mtu"]); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	if err := nicRun("ip", "link", "set", tmpName, "netns", fmt.Sprintf("%d", c.c.InitPid()), "name", name); err != nil {
+		cleanup()
+		return err
+	}
+
+	if _, err := nicNetnsRun(c, "link", "set", name, "up"); err != nil {
+		return err
+	}
+
+	return setNetworkLimits(c, d)
+}
+
+// detachNic removes a nic from the running container, giving physical nics
+// back to the host.
+func (c *lxdContainer) detachNic(d shared.Device) error {
+	name, err := nicContainerName(c, d)
+	if err != nil {
+		return err
+	}
+
+	if d["nictype"] == "physical" {
+		_, err := nicNetnsRun(c, "link", "set", name, "netns", "1", "name", d["parent"])
+		return err
+	}
+
+	_, err = nicNetnsRun(c, "link", "del", name)
+	return err
+}
+
+/*
+ * nicHostName returns the name of the host side of a running container's
+ * veth device, matching it on the (always set) hardware address, or for
+ * nics which were added while the container was running, on the index of
+ * its peer.
+ */
+func nicHostName(c *lxdContainer, d shared.Device) (string, error) {
+	if d["host_name"] != "" {
+		return d["host_name"], nil
+	}
+
+	for i := 0; i < len(c.c.ConfigItem("lxc.network")); i++ {
+		hwaddr := c.c.RunningConfigItem(fmt.Sprintf("lxc.network.%d.hwaddr", i))
+		if len(hwaddr) == 0 || !strings.EqualFold(hwaddr[0], d["hwaddr"]) {
+			continue
+		}
+
+		pair := c.c.RunningConfigItem(fmt.Sprintf("lxc.network.%d.veth.pair", i))
+		if len(pair) == 0 || pair[0] == "" {
+			break
+		}
+
+		return pair[0], nil
+	}
+
+	if name, err := nicContainerName(c, d); err == nil {
+		output, err := nicNetnsRun(c, "-o", "link", "show", name)
+		if err == nil {
+			/* 12: eth1@if13: <BROADCAST,...> */
+			fields := strings.Fields(output)
+			parts := []string{}
+			if len(fields) > 1 {
+				parts = strings.SplitN(strings.TrimSuffix(fields[1], ":"), "@if", 2)
+			}
+			if len(parts) == 2 {
+				index, err := strconv.Atoi(parts[1])
+				if err == nil {
+					if iface, err := net.InterfaceByIndex(index); err == nil {
+						return iface.Name, nil
+					}
+				}
+			}
+		}
+	}
+
+	return "", fmt.Errorf("Couldn't find the host side interface for %s", d["hwaddr"])
+}
+
+// deviceNeedsHotplug tells whether a device changed in a way which requires
+// it to be removed and added again, changes to its limits being applied
+// live.
+func deviceNeedsHotplug(old shared.Device, new shared.Device) bool {
+	for k, v := range old {
+		if !strings.HasPrefix(k, "limits.") && new[k] != v {
+			return true
+		}
+	}
+
+	for k, v := range new {
+		if !strings.HasPrefix(k, "limits.") && old[k] != v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *lxdContainer) attachDevice(d shared.Device) error {
+	switch d["type"] {
+	case "unix-char", "unix-block":
+		return c.attachUnixDevice(d)
+	case "disk":
+		return c.attachDisk(d)
+	case "nic":
+		return c.attachNic(d)
+	}
+
+	return nil
+}
+
+func (c *lxdContainer) detachDevice(d shared.Device) error {
+	switch d["type"] {
+	case "unix-char", "unix-block":
+		return c.detachUnixDevice(d)
+	case "disk":
+		return c.detachDisk(d)
+	case "nic":
+		return c.detachNic(d)
+	}
+
+	return nil
+}
+
+/*
+ * updateDevices brings the devices of the running container in line with
+ * its configuration, oldDevices being those it was started with or last
+ * updated to. Devices which can't be added or removed don't prevent the
+ * others from being updated; all the failures are reported in the error.
+ */
+func (c *lxdContainer) updateDevices(oldDevices shared.Devices) error {
+	failures := []string{}
+
+	for name, old := range oldDevices {
+		if dev, ok := c.devices[name]; ok && !deviceNeedsHotplug(old, dev) {
+			continue
+		}
+
+		if err := c.detachDevice(old); err != nil {
+			failures = append(failures, fmt.Sprintf("Failed removing device %s: %s", name, err))
+		}
+	}
+
+	for name, dev := range c.devices {
+		if old, ok := oldDevices[name]; ok && !deviceNeedsHotplug(old, dev) {
+			continue
+		}
+
+		if err := c.attachDevice(dev); err != nil {
+			failures = append(failures, fmt.Sprintf("Failed adding device %s: %s", name, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+
+	return nil
+}
+
+// containerRunningDevices returns the devices of the named container if it's
+// running, nil otherwise.
+func containerRunningDevices(d *Daemon, name string) shared.Devices {
+	c, err := newLxdContainer(name, d)
+	if err != nil || !c.c.Running() {
+		return nil
+	}
+
+	return c.devices
+}
+
+/*
+ * setNetworkLimits applies the limits.ingress and limits.egress keys of a
+ * nic device to its host side veth. Traffic the container receives is
+ * shaped on the host side's egress, while traffic it sends is policed on
+ * the host side's ingress. Any previously set limits are removed first.
+ */
+func setNetworkLimits(c *lxdContainer, d shared.Device) error {
+	var ingress, egress int64
+	var err error
+
+	if d["limits.ingress"] != "" {
+		ingress, err = shared.ParseBitSizeString(d["limits.ingress"])
+		if err != nil || ingress <= 0 {
+			return fmt.Errorf("Invalid value for limits.ingress: %s", d["limits.ingress"])
+		}
+	}
+
+	if d["limits.egress"] != "" {
+		egress, err = shared.ParseBitSizeString(d["limits.egress"])
+		if err != nil || egress <= 0 {
+			return fmt.Errorf("Invalid value for limits.egress: %s", d["limits.egress"])
+		}
+	}
+
+	if !nicHasHostSide(d) {
+		if ingress == 0 && egress == 0 {
+			return nil
+		}
+		return fmt.Errorf("Network limits are only supported on bridged and p2p nics")
+	}
+
+	veth, err := nicHostName(c, d)
+	if err != nil {
+		if ingress == 0 && egress == 0 {
+			return nil
+		}
+		return err
+	}
+
+	/* These fail when there's nothing to remove, which is fine */
+	exec.Command("tc", "qdisc", "del", "dev", veth, "root").Run()
+	exec.Command("tc", "qdisc", "del", "dev", veth, "ingress").Run()
+
+	commands := [][]string{}
+	if ingress > 0 {
+		rate := fmt.Sprintf("%dbit", ingress)
+		commands = append(commands,
+			[]string{"qdisc", "add", "dev", veth, "root", "handle", "1:0", "htb", "default", "10"},
+			[]string{"class", "add", "dev", veth, "parent", "1:0", "classid", "1:10", "htb", "rate", rate})
+	}
+
+	if egress > 0 {
+		rate := fmt.Sprintf("%dbit", egress)
+		commands = append(commands,
+			[]string{"qdisc", "add", "dev", veth, "ingress", "handle", "ffff:0"},
+			[]string{"filter", "add", "dev", veth, "parent", "ffff:0", "protocol", "all", "u32", "match", "u32", "0", "0", "police", "rate", rate, "burst", "1024k", "mtu", "64kb", "drop", "flowid", ":1"})
+	}
+
+	for _, args := range commands {
+		output, err := exec.Command("tc", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Failed to set network limits on %s: %s", veth, strings.TrimSpace(string(output)))
+		}
+	}
+
+	return nil
+}
+
+// applyNetworkLimits sets up the bandwidth limits of all the running
+// container's nics.
+func (c *lxdContainer) applyNetworkLimits() error {
+	for name, d := range c.devices {
+		if d["type"] != "nic" {
+			continue
+		}
+
+		if err := setNetworkLimits(c, d); err != nil {
+			return fmt.Errorf("Failed setting limits on device %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lxc/lxd/shared"
+)
+
+/*
+ * containerIdmap is the range of host uids and gids an unprivileged
+ * container's ids 0 to Size-1 are mapped to. A nil *containerIdmap stands
+ * for no mapping at all, as used by privileged containers.
+ *
+ * It's stored in the volatile.idmap.* keys as "<uid base>:<gid base>:<size>",
+ * or "none" for no mapping.
+ */
+type containerIdmap struct {
+	Uidbase uint
+	Gidbase uint
+	Size    uint
+}
+
+/*
+ * defaultIdmapSize is the default size of isolated ranges, and that of the
+ * default map, which is never allocated to them.
+ */
+const defaultIdmapSize = 65536
+
+func parseContainerIdmap(value string) (*containerIdmap, error) {
+	if value == "none" {
+		return nil, nil
+	}
+
+	fields := strings.Split(value, ":")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Bad idmap: %q", value)
+	}
+
+	ids := []uint{}
+	for _, field := range fields {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad idmap: %q", value)
+		}
+		ids = append(ids, uint(id))
+	}
+
+	return &containerIdmap{Uidbase: ids[0], Gidbase: ids[1], Size: ids[2]}, nil
+}
+
+func (m *containerIdmap) String() string {
+	if m == nil {
+		return "none"
+	}
+
+	return fmt.Sprintf("%d:%d:%d", m.Uidbase, m.Gidbase, m.Size)
+}
+
+/*
+ * sameIds tells whether a filesystem shifted to m is also shifted to other.
+ * Only the bases matter, the ids of a container never being above those
+ * covered by the smallest of the two.
+ */
+func (m *containerIdmap) sameIds(other *containerIdmap) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+
+	return m.Uidbase == other.Uidbase && m.Gidbase == other.Gidbase
+}
+
+func (m *containerIdmap) hostUid(uid int) int {
+	if m == nil {
+		return uid
+	}
+
+	return int(m.Uidbase) + uid
+}
+
+func (m *containerIdmap) hostGid(gid int) int {
+	if m == nil {
+		return gid
+	}
+
+	return int(m.Gidbase) + gid
+}
+
+/*
+ * nsUid returns the uid in the container of the host uid, or -1 if it isn't
+ * mapped in the container.
+ */
+func (m *containerIdmap) nsUid(uid int) int {
+	if m == nil {
+		return uid
+	}
+
+	if uid < int(m.Uidbase) || uid >= int(m.Uidbase+m.Size) {
+		return -1
+	}
+
+	return uid - int(m.Uidbase)
+}
+
+// nsGid is nsUid for gids.
+func (m *containerIdmap) nsGid(gid int) int {
+	if m == nil {
+		return gid
+	}
+
+	if gid < int(m.Gidbase) || gid >= int(m.Gidbase+m.Size) {
+		return -1
+	}
+
+	return gid - int(m.Gidbase)
+}
+
+// idmapSet returns the map as a shared.IdmapSet, nil for no mapping.
+func (m *containerIdmap) idmapSet() (*shared.IdmapSet, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	set := shared.IdmapSet{}
+	set, err := set.Append(fmt.Sprintf("u:0:%d:%d", m.Uidbase, m.Size))
+	if err != nil {
+		return nil, err
+	}
+	set, err = set.Append(fmt.Sprintf("g:0:%d:%d", m.Gidbase, m.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	return &set, nil
+}
+
+/*
+ * shiftRootfs changes the owners of the files under p, which are shifted to
+ * the from map, to the to map.
+ */
+func shiftRootfs(p string, from *containerIdmap, to *containerIdmap) error {
+	if from.sameIds(to) {
+		return nil
+	}
+
+	var uidstr, gidstr string
+	switch {
+	case from == nil:
+		uidstr = fmt.Sprintf("u:0:%d:%d", to.Uidbase, to.Size)
+		gidstr = fmt.Sprintf("g:0:%d:%d", to.Gidbase, to.Size)
+	case to == nil:
+		uidstr = fmt.Sprintf("u:%d:0:%d", from.Uidbase, from.Size)
+		gidstr = fmt.Sprintf("g:%d:0:%d", from.Gidbase, from.Size)
+	default:
+		size := from.Size
+		if to.Size < size {
+			size = to.Size
+		}
+		uidstr = fmt.Sprintf("u:%d:%d:%d", from.Uidbase, to.Uidbase, size)
+		gidstr = fmt.Sprintf("g:%d:%d:%d", from.Gidbase, to.Gidbase, size)
+	}
+
+	set := shared.IdmapSet{}
+	set, err := set.Append(uidstr)
+	if err != nil {
+		return err
+	}
+	set, err = set.Append(gidstr)
+	if err != nil {
+		return err
+	}
+
+	return shared.Uidshift(p, set, false)
+}
+
+/*
+ * defaultIdmap returns the map shared by all the containers which don't
+ * ask for an isolated one: the start of LXD's allocation, the rest being
+ * left to isolated ranges.
+ */
+func (d *Daemon) defaultIdmap() *containerIdmap {
+	size := d.idmapLimit()
+	if size > defaultIdmapSize {
+		size = defaultIdmapSize
+	}
+
+	return &containerIdmap{Uidbase: d.idMap.Uidmin, Gidbase: d.idMap.Gidmin, Size: size}
+}
+
+/* Serializes allocations, so two containers can't get the same range */
+var idmapLock sync.Mutex
+
+// idmapLimit returns the number of ids of LXD's allocation usable for maps.
+func (d *Daemon) idmapLimit() uint {
+	limit := d.idMap.Uidrange
+	if d.idMap.Gidrange < limit {
+		limit = d.idMap.Gidrange
+	}
+
+	return limit
+}
+
+/*
+ * idmapUsedRanges returns the ranges of LXD's allocation from /etc/subuid
+ * and /etc/subgid which are taken, by the default map or by any isolated
+ * container other than name, as [start, end) offsets into the allocation.
+ * Ranges are always allocated at the same offset in the uid and gid
+ * allocations.
+ */
+func (d *Daemon) idmapUsedRanges(name string) ([][2]uint, error) {
+	q := `SELECT containers.name, containers_config.value FROM containers_config
+		JOIN containers ON containers_config.container_id=containers.id
+		WHERE containers.type=? AND containers_config.key IN (?, ?)`
+	var cname, value string
+	inargs := []interface{}{cTypeRegular, "volatile.idmap.next", "volatile.idmap.current"}
+	outfmt := []interface{}{cname, value}
+	results, err := shared.DbQueryScan(d.db, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	used := [][2]uint{{0, defaultIdmapSize}}
+	for _, r := range results {
+		if r[0].(string) == name {
+			continue
+		}
+
+		m, err := parseContainerIdmap(r[1].(string))
+		if err != nil || m == nil || m.Uidbase < d.idMap.Uidmin {
+			continue
+		}
+
+		start := m.Uidbase - d.idMap.Uidmin
+		used = append(used, [2]uint{start, start + m.Size})
+	}
+
+	return used, nil
+}
+
+func rangeIsFree(used [][2]uint, start uint, end uint) bool {
+	for _, r := range used {
+		if start < r[1] && r[0] < end {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+ * idmapAllocate finds a free range of size ids for the container name.
+ * idmapLock must be held until the allocation is recorded.
+ */
+func (d *Daemon) idmapAllocate(name string, size uint) (*containerIdmap, error) {
+	used, err := d.idmapUsedRanges(name)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := d.idmapLimit()
+
+	/* The lowest free range starts right after a used one */
+	candidates := []int{}
+	for _, r := range used {
+		candidates = append(candidates, int(r[1]))
+	}
+	sort.Ints(candidates)
+
+	for _, c := range candidates {
+		start := uint(c)
+		if start+size > limit {
+			break
+		}
+
+		if rangeIsFree(used, start, start+size) {
+			return &containerIdmap{Uidbase: d.idMap.Uidmin + start, Gidbase: d.idMap.Gidmin + start, Size: size}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Not enough uids and gids left for an isolated map of %d ids", size)
+}
+
+// idmapSize returns the size of the isolated range the container asks for.
+func (c *lxdContainer) idmapSize() (uint, error) {
+	size, err := strconv.ParseUint(configValue(c.config, "security.idmap.size"), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(size), nil
+}
+
+/*
+ * setupIdmap picks the map the container is to run with: none for
+ * privileged containers, the isolated range recorded in volatile.idmap.next
+ * if security.idmap.isolated is set, the default map otherwise. It only
+ * reads what allocateIdmap recorded when the configuration was written.
+ */
+func (c *lxdContainer) setupIdmap() error {
+	d := c.daemon
+	c.idmapPending = false
+
+	if c.isPrivileged() {
+		c.idmap = nil
+		return nil
+	}
+
+	if d.idMap == nil {
+		return fmt.Errorf("LXD doesn't have a uid/gid allocation")
+	}
+
+	c.idmap = d.defaultIdmap()
+	if !isTrue(c.config["security.idmap.isolated"]) {
+		return nil
+	}
+
+	size, err := c.idmapSize()
+	if err != nil {
+		return err
+	}
+
+	next, err := parseContainerIdmap(c.config["volatile.idmap.next"])
+	if c.config["volatile.idmap.next"] == "" || err != nil || next == nil || next.Size != size {
+		/* Not starting it with the default map, see shiftIdmap */
+		c.idmapPending = true
+		return nil
+	}
+
+	c.idmap = next
+	return nil
+}
+
+/*
+ * allocateIdmap records the isolated range of a container which asks for
+ * one in volatile.idmap.next, keeping the one it has unless its size
+ * changed or another container has it too (as copies come with that of
+ * their source), and releases it once the container isn't isolated
+ * anymore. It's called whenever the configuration of the container (or of
+ * one of its profiles) is written, never when it's only loaded.
+ */
+func (c *lxdContainer) allocateIdmap() error {
+	d := c.daemon
+
+	if c.isPrivileged() || !isTrue(c.config["security.idmap.isolated"]) {
+		if c.config["volatile.idmap.next"] == "" {
+			return nil
+		}
+
+		if err := dbContainerConfigSet(d, c.id, "volatile.idmap.next", ""); err != nil {
+			return err
+		}
+		delete(c.config, "volatile.idmap.next")
+		return nil
+	}
+
+	if d.idMap == nil {
+		return fmt.Errorf("LXD doesn't have a uid/gid allocation")
+	}
+
+	size, err := c.idmapSize()
+	if err != nil {
+		return err
+	}
+
+	idmapLock.Lock()
+	defer idmapLock.Unlock()
+
+	next, err := parseContainerIdmap(c.config["volatile.idmap.next"])
+	if c.config["volatile.idmap.next"] != "" && err == nil && next != nil && next.Size == size {
+		used, err := d.idmapUsedRanges(c.name)
+		if err != nil {
+			return err
+		}
+
+		start := next.Uidbase - d.idMap.Uidmin
+		if next.Uidbase >= d.idMap.Uidmin && rangeIsFree(used, start, start+size) {
+			c.idmap = next
+			c.idmapPending = false
+			return nil
+		}
+	}
+
+	next, err = d.idmapAllocate(c.name, size)
+	if err != nil {
+		return err
+	}
+
+	if err := dbContainerConfigSet(d, c.id, "volatile.idmap.next", next.String()); err != nil {
+		return err
+	}
+
+	c.config["volatile.idmap.next"] = next.String()
+	c.idmap = next
+	c.idmapPending = false
+	return nil
+}
+
+/*
+ * containerAllocateIdmap loads the named container and records its
+ * isolated range, see allocateIdmap.
+ */
+func containerAllocateIdmap(d *Daemon, name string) (*lxdContainer, error) {
+	c, err := newLxdContainer(name, d)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.allocateIdmap(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+/*
+ * currentIdmap returns the map the container's rootfs is shifted to.
+ * Containers created before this was recorded were all shifted to the
+ * default map.
+ */
+func (c *lxdContainer) currentIdmap() (*containerIdmap, error) {
+	if c.config["volatile.idmap.current"] == "" {
+		return c.daemon.defaultIdmap(), nil
+	}
+
+	return parseContainerIdmap(c.config["volatile.idmap.current"])
+}
+
+/*
+ * shiftIdmap shifts the container's rootfs to the map it's about to be
+ * started with if it's shifted to another one, and records that.
+ */
+func (c *lxdContainer) shiftIdmap() error {
+	if c.idmapPending {
+		return fmt.Errorf("No isolated idmap was allocated to the container")
+	}
+
+	current, err := c.currentIdmap()
+	if err != nil {
+		return err
+	}
+
+	if !current.sameIds(c.idmap) {
+		shared.Debugf("Shifting the rootfs of %s from %s to %s\n", c.name, current, c.idmap)
+
+		rpath := shared.VarPath("lxc", c.name, "rootfs")
+		if err := shiftRootfs(rpath, current, c.idmap); err != nil {
+			return fmt.Errorf("Failed to shift the rootfs: %s", err)
+		}
+
+		if err := setUnprivUserAcl(c.idmap, shared.VarPath("lxc", c.name)); err != nil {
+			shared.Debugf("Error adding acl for container root: start will likely fail\n")
+		}
+	}
+
+	/* Recorded before anything else can fail, the rootfs is shifted now */
+	if c.config["volatile.idmap.current"] != c.idmap.String() {
+		if err := dbContainerConfigSet(c.daemon, c.id, "volatile.idmap.current", c.idmap.String()); err != nil {
+			return err
+		}
+		c.config["volatile.idmap.current"] = c.idmap.String()
+	}
+
+	/* The saved state has the old ids */
+	if !current.sameIds(c.idmap) {
+		if err := c.clearState(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
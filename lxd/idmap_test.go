@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lxc/lxd/shared"
+)
+
+func TestRangeIsFree(t *testing.T) {
+	used := [][2]uint{{0, 65536}, {131072, 196608}}
+
+	if !rangeIsFree(used, 65536, 131072) {
+		t.Error("The gap between two ranges isn't free")
+	}
+
+	if !rangeIsFree(used, 196608, 262144) {
+		t.Error("The range right after the last one isn't free")
+	}
+
+	if rangeIsFree(used, 65535, 131072) {
+		t.Error("A range overlapping the first one is free")
+	}
+
+	if rangeIsFree(used, 100000, 140000) {
+		t.Error("A range overlapping the second one is free")
+	}
+
+	if rangeIsFree(used, 0, 300000) {
+		t.Error("A range covering both is free")
+	}
+}
+
+func testIdmapDaemon(t *testing.T, size uint) (*Daemon, func()) {
+	dir, err := ioutil.TempDir("", "lxd_idmap_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := createDb(filepath.Join(dir, "lxd.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	d := &Daemon{db: db, idMap: &shared.Idmap{Uidmin: 100000, Uidrange: size, Gidmin: 200000, Gidrange: size}}
+	return d, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testIdmapContainer(t *testing.T, d *Daemon, name string, idmap string) {
+	res, err := d.db.Exec("INSERT INTO containers (name, architecture, type) VALUES (?, 0, ?)", name, cTypeRegular)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.db.Exec("INSERT INTO containers_config (container_id, key, value) VALUES (?, ?, ?)", id, "volatile.idmap.next", idmap); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultIdmap(t *testing.T) {
+	d, cleanup := testIdmapDaemon(t, 1000000)
+	defer cleanup()
+
+	m := d.defaultIdmap()
+	if m.Uidbase != 100000 || m.Gidbase != 200000 || m.Size != defaultIdmapSize {
+		t.Errorf("Bad default map: %s", m)
+	}
+
+	d.idMap.Uidrange = 1000
+	if m := d.defaultIdmap(); m.Size != 1000 {
+		t.Errorf("The default map is larger than the allocation: %s", m)
+	}
+}
+
+func TestIdmapAllocate(t *testing.T) {
+	d, cleanup := testIdmapDaemon(t, 4*65536)
+	defer cleanup()
+
+	/* The first range comes right after the default map */
+	m, err := d.idmapAllocate("c1", 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Uidbase != 100000+65536 || m.Gidbase != 200000+65536 || m.Size != 65536 {
+		t.Errorf("Bad first range: %s", m)
+	}
+	testIdmapContainer(t, d, "c1", m.String())
+
+	/* Another container gets the next one */
+	m, err = d.idmapAllocate("c2", 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Uidbase != 100000+2*65536 {
+		t.Errorf("Bad second range: %s", m)
+	}
+	testIdmapContainer(t, d, "c2", m.String())
+
+	/* A container's own range doesn't count as used for it */
+	m, err = d.idmapAllocate("c1", 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Uidbase != 100000+65536 {
+		t.Errorf("c1 didn't get its own range back: %s", m)
+	}
+
+	/* Only one range is left */
+	if _, err := d.idmapAllocate("c3", 2*65536); err == nil {
+		t.Error("A range larger than what's left was allocated")
+	}
+
+	m, err = d.idmapAllocate("c3", 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Uidbase != 100000+3*65536 {
+		t.Errorf("Bad last range: %s", m)
+	}
+}
@@ -109,9 +109,21 @@ func run() error {
 
 	defer d.db.Close()
 
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT)
 	signal.Notify(ch, syscall.SIGTERM)
-	<-ch
+	signal.Notify(ch, syscall.SIGPWR)
+	sig := <-ch
+
+	/*
+	 * SIGPWR is what init sends when the host is going down, in which case
+	 * the containers are shut down too; otherwise they're left running.
+	 */
+	if sig == syscall.SIGPWR {
+		if err := containersShutdown(d); err != nil {
+			shared.Logf("Failed to shut the containers down: %s", err)
+		}
+	}
+
 	return d.Stop()
 }
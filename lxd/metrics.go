@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/shared"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+func cgroupInt(c *lxc.Container, key string) int64 {
+	value := c.CgroupItem(key)
+	if len(value) == 0 {
+		return 0
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(value[0]), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+/*
+ * cgroupPath returns the path of the process pid's cgroup in the hierarchy
+ * of controller.
+ */
+func cgroupPath(pid int, controller string) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		for _, c := range strings.Split(fields[1], ",") {
+			if c == controller {
+				return filepath.Join(CGROUP_PATH, controller, fields[2]), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("No %s cgroup for %d", controller, pid)
+}
+
+/*
+ * cgroupProcs returns the pids (in the host's namespace) of the processes
+ * in the cgroup root and those below it.
+ */
+func cgroupProcs(root string) []int {
+	pids := []int{}
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Name() != "cgroup.procs" {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			pid, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+			if err == nil {
+				pids = append(pids, pid)
+			}
+		}
+
+		return nil
+	})
+
+	return pids
+}
+
+/*
+ * processCount counts the processes in the container, including those in
+ * cgroups created below the container's (by systemd, say).
+ */
+func processCount(c *lxc.Container) int64 {
+	if cgroupPidsController() {
+		return cgroupInt(c, "pids.current")
+	}
+
+	root, err := cgroupPath(c.InitPid(), "memory")
+	if err != nil {
+		return 0
+	}
+
+	return int64(len(cgroupProcs(root)))
+}
+
+/*
+ * parseNetDev parses the content of /proc/net/dev into the counters of each
+ * interface.
+ */
+func parseNetDev(r io.Reader) (map[string]shared.ContainerNetworkCounters, error) {
+	counters := map[string]shared.ContainerNetworkCounters{}
+
+	scanner := bufio.NewScanner(r)
+	for i := 0; scanner.Scan(); i++ {
+		/* Skip the two header lines */
+		if i < 2 {
+			continue
+		}
+
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		values := strings.Fields(fields[1])
+		if len(values) < 10 {
+			return nil, fmt.Errorf("Bad line in /proc/net/dev: %s", scanner.Text())
+		}
+
+		n := []int64{}
+		for _, idx := range []int{0, 1, 8, 9} {
+			v, err := strconv.ParseInt(values[idx], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, v)
+		}
+
+		counters[strings.TrimSpace(fields[0])] = shared.ContainerNetworkCounters{
+			BytesReceived:   n[0],
+			PacketsReceived: n[1],
+			BytesSent:       n[2],
+			PacketsSent:     n[3],
+		}
+	}
+
+	return counters, scanner.Err()
+}
+
+/*
+ * networkCounters returns the counters of the container's interfaces.
+ * /proc/<pid>/net/dev shows those of the network namespace of pid, so
+ * there's no need to enter it.
+ */
+func networkCounters(c *lxc.Container) (map[string]shared.ContainerNetworkCounters, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", c.InitPid()))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseNetDev(f)
+}
+
+// diskUsage returns the space used by the container's rootfs.
+func (c *lxdContainer) diskUsage() (int64, error) {
+	output, err := exec.Command("du", "-s", "-x", "-B1", shared.VarPath("lxc", c.name, "rootfs")).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Unexpected output from du: %q", string(output))
+	}
+
+	return strconv.ParseInt(fields[0], 10, 64)
+}
+
+/*
+ * containerMetrics gathers the resource usage of the running container,
+ * but its disk usage, which is too costly to get for every scrape. It's
+ * best effort: whatever can't be read (the host missing swap accounting,
+ * say) is left at zero.
+ */
+func containerMetrics(c *lxc.Container) *shared.ContainerMetrics {
+	m := shared.ContainerMetrics{
+		CPUTime:    cgroupInt(c, "cpuacct.usage"),
+		Memory:     cgroupInt(c, "memory.usage_in_bytes"),
+		MemoryPeak: cgroupInt(c, "memory.max_usage_in_bytes"),
+		Processes:  processCount(c),
+		Network:    map[string]shared.ContainerNetworkCounters{},
+	}
+
+	if cgroupSwapAccounting() {
+		if swap := cgroupInt(c, "memory.memsw.usage_in_bytes") - m.Memory; swap > 0 {
+			m.Swap = swap
+		}
+	}
+
+	if counters, err := networkCounters(c); err == nil {
+		m.Network = counters
+	} else {
+		shared.Debugf("Error getting the network counters of %s: %s\n", c.Name(), err)
+	}
+
+	return &m
+}
+
+// metrics gathers the resource usage of the running container.
+func (c *lxdContainer) metrics() *shared.ContainerMetrics {
+	m := containerMetrics(c.c)
+
+	if disk, err := c.diskUsage(); err == nil {
+		m.Disk = disk
+	} else {
+		shared.Debugf("Error getting the disk usage of %s: %s\n", c.name, err)
+	}
+
+	return m
+}
+
+/*
+ * statusWriter remembers the status code of the response for the request
+ * statistics. It has to be hijackable for the websockets.
+ */
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection can't be hijacked")
+	}
+
+	return h.Hijack()
+}
+
+type httpStatsKey struct {
+	method string
+	uri    string
+	code   int
+}
+
+type httpStats struct {
+	count    int64
+	duration time.Duration
+}
+
+var httpStatsLock sync.Mutex
+var httpRequests = map[httpStatsKey]*httpStats{}
+
+// httpRecord records a request to the API endpoint uri, as registered with
+// the router (so all the containers' requests are counted together).
+func httpRecord(method string, uri string, code int, duration time.Duration) {
+	httpStatsLock.Lock()
+	defer httpStatsLock.Unlock()
+
+	key := httpStatsKey{method, uri, code}
+	stats, ok := httpRequests[key]
+	if !ok {
+		stats = &httpStats{}
+		httpRequests[key] = stats
+	}
+
+	stats.count++
+	stats.duration += duration
+}
+
+/*
+ * promWriter builds a page in the Prometheus text format, emitting the
+ * HELP and TYPE lines of each metric before its first sample.
+ */
+type promWriter struct {
+	buf  bytes.Buffer
+	seen map[string]bool
+}
+
+func promEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (p *promWriter) header(name string, kind string, help string) {
+	if p.seen == nil {
+		p.seen = map[string]bool{}
+	}
+
+	if !p.seen[name] {
+		fmt.Fprintf(&p.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		p.seen[name] = true
+	}
+}
+
+func (p *promWriter) sample(name string, kind string, help string, labels map[string]string, value float64) {
+	p.header(name, kind, help)
+	p.line(name, labels, value)
+}
+
+/*
+ * summary writes a summary without quantiles, that is the sum of the
+ * observations and their count.
+ */
+func (p *promWriter) summary(name string, help string, labels map[string]string, sum float64, count int64) {
+	p.header(name, "summary", help)
+	p.line(name+"_sum", labels, sum)
+	p.line(name+"_count", labels, float64(count))
+}
+
+func (p *promWriter) line(name string, labels map[string]string, value float64) {
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", k, promEscape(labels[k])))
+	}
+
+	if len(pairs) > 0 {
+		fmt.Fprintf(&p.buf, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'g', -1, 64))
+	} else {
+		fmt.Fprintf(&p.buf, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+}
+
+/*
+ * metricsContainers reports the resource usage of the containers. Rather
+ * than loading them (which sets them up), it only asks liblxc for their
+ * state and reads their cgroups.
+ */
+func metricsContainers(d *Daemon, p *promWriter) error {
+	q := "SELECT name FROM containers WHERE type=? ORDER BY name"
+	inargs := []interface{}{cTypeRegular}
+	var name string
+	outfmt := []interface{}{name}
+
+	result, err := shared.DbQueryScan(d.db, q, inargs, outfmt)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range result {
+		name := r[0].(string)
+		c, err := lxc.NewContainer(name, d.lxcpath)
+		if err != nil {
+			shared.Debugf("Error getting the state of %s: %s\n", name, err)
+			continue
+		}
+
+		labels := map[string]string{"name": name}
+
+		running := 0.0
+		if c.Running() {
+			running = 1
+		}
+		p.sample("lxd_container_running", "gauge", "Whether the container is running.", labels, running)
+
+		if running == 0 {
+			continue
+		}
+
+		m := containerMetrics(c)
+		p.sample("lxd_container_cpu_seconds_total", "counter", "CPU time used by the container.", labels, time.Duration(m.CPUTime).Seconds())
+		p.sample("lxd_container_memory_bytes", "gauge", "Memory used by the container.", labels, float64(m.Memory))
+		p.sample("lxd_container_memory_peak_bytes", "gauge", "Peak memory usage of the container.", labels, float64(m.MemoryPeak))
+		p.sample("lxd_container_swap_bytes", "gauge", "Swap used by the container.", labels, float64(m.Swap))
+		p.sample("lxd_container_processes", "gauge", "Number of processes in the container.", labels, float64(m.Processes))
+
+		ifaces := []string{}
+		for iface := range m.Network {
+			ifaces = append(ifaces, iface)
+		}
+		sort.Strings(ifaces)
+
+		for _, iface := range ifaces {
+			n := m.Network[iface]
+			nl := map[string]string{"name": name, "interface": iface}
+			p.sample("lxd_container_network_receive_bytes_total", "counter", "Bytes received by the container's interface.", nl, float64(n.BytesReceived))
+			p.sample("lxd_container_network_transmit_bytes_total", "counter", "Bytes sent by the container's interface.", nl, float64(n.BytesSent))
+			p.sample("lxd_container_network_receive_packets_total", "counter", "Packets received by the container's interface.", nl, float64(n.PacketsReceived))
+			p.sample("lxd_container_network_transmit_packets_total", "counter", "Packets sent by the container's interface.", nl, float64(n.PacketsSent))
+		}
+	}
+
+	return nil
+}
+
+func metricsOperations(p *promWriter) {
+	counts := map[string]int{}
+
+	lock.Lock()
+	for _, op := range operations {
+		counts[op.Status]++
+	}
+	lock.Unlock()
+
+	statuses := []string{}
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	for _, status := range statuses {
+		p.sample("lxd_operations", "gauge", "Number of operations by status.", map[string]string{"status": status}, float64(counts[status]))
+	}
+}
+
+func metricsHTTP(p *promWriter) {
+	/* Sorted by URI, method and code, for a stable output */
+	names := []string{}
+	keys := map[string]httpStatsKey{}
+	stats := map[httpStatsKey]httpStats{}
+
+	httpStatsLock.Lock()
+	for k, v := range httpRequests {
+		name := fmt.Sprintf("%s %s %03d", k.uri, k.method, k.code)
+		names = append(names, name)
+		keys[name] = k
+		stats[k] = *v
+	}
+	httpStatsLock.Unlock()
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		k := keys[name]
+		labels := map[string]string{"method": k.method, "uri": k.uri, "code": strconv.Itoa(k.code)}
+		p.summary("lxd_http_request_duration_seconds", "Time spent handling API requests.", labels, stats[k].duration.Seconds(), stats[k].count)
+	}
+}
+
+func metricsImages(p *promWriter) {
+	size := int64(0)
+	filepath.Walk(shared.VarPath("images"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	p.sample("lxd_images_size_bytes", "gauge", "Size of the image store.", nil, float64(size))
+}
+
+func metricsDb(p *promWriter) {
+	stats := shared.DbStats()
+
+	kinds := []string{}
+	for kind := range stats {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		labels := map[string]string{"kind": kind}
+		p.summary("lxd_db_query_duration_seconds", "Time spent running database queries, retries included.", labels, stats[kind].Duration.Seconds(), stats[kind].Count)
+	}
+}
+
+func metricsGet(d *Daemon, r *http.Request) Response {
+	p := &promWriter{}
+
+	if err := metricsContainers(d, p); err != nil {
+		return InternalError(err)
+	}
+	metricsOperations(p)
+	metricsHTTP(p)
+	metricsImages(p)
+	metricsDb(p)
+
+	return TextResponse("text/plain; version=0.0.4", p.buf.String())
+}
+
+var metricsCmd = Command{name: "metrics", get: metricsGet}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNetDev(t *testing.T) {
+	content := `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1200      12    0    0    0     0          0         0     1200      12    0    0    0     0       0          0
+  eth0: 4352810    3256    0    0    0     0          0         0   281093    2345    0    0    0     0       0          0
+`
+
+	counters, err := parseNetDev(strings.NewReader(content))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(counters) != 2 {
+		t.Errorf("Expected 2 interfaces, got %d", len(counters))
+		return
+	}
+
+	eth0 := counters["eth0"]
+	if eth0.BytesReceived != 4352810 || eth0.PacketsReceived != 3256 || eth0.BytesSent != 281093 || eth0.PacketsSent != 2345 {
+		t.Errorf("Bad counters for eth0: %+v", eth0)
+	}
+}
+
+func TestParseNetDevBadLine(t *testing.T) {
+	content := "header\nheader\n  eth0: 1 2 3\n"
+
+	if _, err := parseNetDev(strings.NewReader(content)); err == nil {
+		t.Error("Truncated line accepted")
+	}
+}
+
+func TestPromWriter(t *testing.T) {
+	p := &promWriter{}
+	p.sample("lxd_test", "gauge", "A test.", map[string]string{"name": "foo", "a": "x\"y"}, 1.5)
+	p.sample("lxd_test", "gauge", "A test.", map[string]string{"name": "bar"}, 2)
+	p.sample("lxd_other", "counter", "Another test.", nil, 1e10)
+
+	expected := `# HELP lxd_test A test.
+# TYPE lxd_test gauge
+lxd_test{a="x\"y",name="foo"} 1.5
+lxd_test{name="bar"} 2
+# HELP lxd_other Another test.
+# TYPE lxd_other counter
+lxd_other 1e+10
+`
+
+	if p.buf.String() != expected {
+		t.Errorf("Bad output:\n%s", p.buf.String())
+	}
+}
+
+func TestPromWriterSummary(t *testing.T) {
+	p := &promWriter{}
+	p.summary("lxd_test_seconds", "A test.", map[string]string{"kind": "exec"}, 0.5, 3)
+
+	expected := `# HELP lxd_test_seconds A test.
+# TYPE lxd_test_seconds summary
+lxd_test_seconds_sum{kind="exec"} 0.5
+lxd_test_seconds_count{kind="exec"} 3
+`
+
+	if p.buf.String() != expected {
+		t.Errorf("Bad output:\n%s", p.buf.String())
+	}
+}
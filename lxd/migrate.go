@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/lxc/lxd/lxd/migration"
+	"github.com/lxc/lxd/shared"
+)
+
+func migrationConfig(config map[string]string) []*migration.Config {
+	keys := []string{}
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := []*migration.Config{}
+	for _, k := range keys {
+		result = append(result, &migration.Config{Key: proto.String(k), Value: proto.String(config[k])})
+	}
+
+	return result
+}
+
+func configFromMigration(config []*migration.Config) map[string]string {
+	result := map[string]string{}
+	for _, c := range config {
+		result[c.GetKey()] = c.GetValue()
+	}
+
+	return result
+}
+
+/*
+ * migrationSnapshots describes the container's snapshots, so that the
+ * migration sink can recreate them.
+ */
+func migrationSnapshots(d *Daemon, c *lxdContainer) ([]*migration.Snapshot, error) {
+	prefix := fmt.Sprintf("%s/", c.name)
+	q := "SELECT id, name, ephemeral FROM containers WHERE type=? AND SUBSTR(name,1,?)=? ORDER BY id"
+	var id, ephemeral int
+	var name string
+	inargs := []interface{}{cTypeSnapshot, len(prefix), prefix}
+	outfmt := []interface{}{id, name, ephemeral}
+	results, err := shared.DbQueryScan(d.db, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []*migration.Snapshot{}
+	for _, r := range results {
+		/* Only the things dbGetConfig and dbGetProfiles look at */
+		snap := &lxdContainer{id: r[0].(int), name: r[1].(string)}
+		sname := strings.TrimPrefix(snap.name, prefix)
+
+		config, err := dbGetConfig(d, snap)
+		if err != nil {
+			return nil, err
+		}
+
+		profiles, err := dbGetProfiles(d, snap)
+		if err != nil {
+			return nil, err
+		}
+
+		devices, err := dbGetDevices(d, snap.name, false)
+		if err != nil {
+			return nil, err
+		}
+
+		deviceNames := []string{}
+		for name := range devices {
+			deviceNames = append(deviceNames, name)
+		}
+		sort.Strings(deviceNames)
+
+		migrationDevices := []*migration.Device{}
+		for _, name := range deviceNames {
+			migrationDevices = append(migrationDevices, &migration.Device{
+				Name:   proto.String(name),
+				Config: migrationConfig(devices[name]),
+			})
+		}
+
+		/* Every snapshot has a state directory, only stateful ones fill it */
+		state, _ := ioutil.ReadDir(snapshotStateDir(c, sname))
+
+		snapshots = append(snapshots, &migration.Snapshot{
+			Name:      proto.String(sname),
+			Config:    migrationConfig(config),
+			Profiles:  profiles,
+			Ephemeral: proto.Bool(r[2].(int) == 1),
+			Devices:   migrationDevices,
+			Stateful:  proto.Bool(len(state) > 0),
+		})
+	}
+
+	return snapshots, nil
+}
+
+// migrationConfigInt returns an integer key of the container, or its default.
+func migrationConfigInt(c *lxdContainer, key string) int {
+	value, err := strconv.Atoi(configValue(c.config, key))
+	if err != nil {
+		value, _ = strconv.Atoi(containerConfigKeys[key].Default)
+	}
+
+	return value
+}
+
+/*
+ * migrationSourceArgs sets up the source end of a migration of the
+ * container, along with its snapshots unless containerOnly is set.
+ */
+func migrationSourceArgs(d *Daemon, c *lxdContainer, containerOnly bool) (*migration.MigrationSourceArgs, error) {
+	args := migration.MigrationSourceArgs{Container: c.c, Stopped: c.stopped, Restore: c.restore}
+
+	idmap, err := c.currentIdmap()
+	if err != nil {
+		return nil, err
+	}
+
+	args.Idmap, err = idmap.idmapSet()
+	if err != nil {
+		return nil, err
+	}
+
+	if !containerOnly {
+		snapshots, err := migrationSnapshots(d, c)
+		if err != nil {
+			return nil, err
+		}
+		args.Snapshots = snapshots
+	}
+
+	if isTrue(c.config["migration.incremental.memory"]) {
+		args.PredumpRounds = migrationConfigInt(c, "migration.incremental.memory.iterations")
+		args.PredumpGoal = migrationConfigInt(c, "migration.incremental.memory.goal")
+	}
+
+	return &args, nil
+}
+
+/*
+ * migrationCreateSnapshot creates the database entry of a snapshot the
+ * migration source sent, whose files are already in place.
+ */
+func migrationCreateSnapshot(d *Daemon, cname string, snap *migration.Snapshot) error {
+	if snap.GetName() == "" || snap.GetName() == "." || snap.GetName() == ".." || strings.Contains(snap.GetName(), "/") {
+		return fmt.Errorf("Invalid snapshot name: %q", snap.GetName())
+	}
+
+	fullName := fmt.Sprintf("%s/%s", cname, snap.GetName())
+	id, err := dbCreateContainer(d, fullName, cTypeSnapshot, configFromMigration(snap.GetConfig()), snap.GetProfiles(), snap.GetEphemeral())
+	if err != nil {
+		return err
+	}
+
+	devices := shared.Devices{}
+	for _, dev := range snap.GetDevices() {
+		devices[dev.GetName()] = shared.Device(configFromMigration(dev.GetConfig()))
+	}
+
+	if len(devices) == 0 {
+		return nil
+	}
+
+	tx, err := shared.DbBegin(d.db)
+	if err != nil {
+		dbRemoveSnapshot(d, cname, snap.GetName())
+		return err
+	}
+
+	if err := shared.AddDevices(tx, "container", id, devices); err != nil {
+		tx.Rollback()
+		dbRemoveSnapshot(d, cname, snap.GetName())
+		return err
+	}
+
+	if err := shared.TxCommit(tx); err != nil {
+		dbRemoveSnapshot(d, cname, snap.GetName())
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * migrationProgress keeps the progress of the transfers of a migration in
+ * the metadata of its operation, under "progress".
+ */
+type migrationProgress struct {
+	lock     sync.Mutex
+	op       string
+	channels map[string]migration.Progress
+}
+
+func newMigrationProgress() *migrationProgress {
+	return &migrationProgress{channels: map[string]migration.Progress{}}
+}
+
+func (p *migrationProgress) setOperation(op string) {
+	p.lock.Lock()
+	p.op = op
+	p.lock.Unlock()
+}
+
+func (p *migrationProgress) update(channel string, progress migration.Progress) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.channels[channel] = progress
+	if p.op == "" {
+		return
+	}
+
+	if err := OperationUpdateMetadata(p.op, shared.Jmap{"progress": p.channels}); err != nil {
+		shared.Debugf("error updating the progress of %s: %s", p.op, err)
+	}
+}
@@ -8,10 +8,13 @@ package migration
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	/*
@@ -31,6 +34,21 @@ import (
 	"gopkg.in/lxc/go-lxc.v2"
 )
 
+/*
+ * How long the end of a migration which is waiting for the other one to
+ * connect to its websockets waits before giving up.
+ */
+const connectTimeout = 30 * time.Second
+
+/*
+ * How long connecting to the other end of a migration may take. It's well
+ * under connectTimeout so that, when an end can't reach the other (one
+ * behind NAT, say), it gives up while the other is still waiting, and a
+ * client told so (see shared.MigrationUnreachable) can try the other way
+ * around.
+ */
+const dialTimeout = 10 * time.Second
+
 type migrationFields struct {
 	live bool
 
@@ -44,10 +62,80 @@ type migrationFields struct {
 	fsConn   *websocket.Conn
 
 	container *lxc.Container
+
+	fsProgress   *progressTracker
+	criuProgress *progressTracker
+
+	/* Guards the websockets against Cancel, until they're all connected */
+	lock      sync.Mutex
+	cancelled chan bool
+}
+
+func newMigrationFields(container *lxc.Container, live bool, progress ProgressFunc) migrationFields {
+	return migrationFields{
+		live:         live,
+		container:    container,
+		fsProgress:   newProgressTracker("fs", progress),
+		criuProgress: newProgressTracker("criu", progress),
+		cancelled:    make(chan bool),
+	}
+}
+
+/*
+ * setConn sets one of the websockets, unless the migration was cancelled
+ * meanwhile.
+ */
+func (c *migrationFields) setConn(conn **websocket.Conn, ws *websocket.Conn) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	select {
+	case <-c.cancelled:
+		ws.Close()
+		return fmt.Errorf("Migration cancelled")
+	default:
+	}
+
+	*conn = ws
+	return nil
+}
+
+/*
+ * Cancel aborts the migration: it closes the websockets, which makes both
+ * ends fail, telling the other one why.
+ */
+func (c *migrationFields) Cancel() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	select {
+	case <-c.cancelled:
+		return nil
+	default:
+	}
+	close(c.cancelled)
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Migration cancelled")
+	for _, conn := range []*websocket.Conn{c.controlConn, c.fsConn, c.criuConn} {
+		if conn != nil {
+			conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			conn.Close()
+		}
+	}
+
+	return nil
 }
 
 func (c *migrationFields) send(m proto.Message) error {
-	w, err := c.controlConn.NextWriter(websocket.BinaryMessage)
+	return sendMessage(c.controlConn, m)
+}
+
+func (c *migrationFields) recv(m proto.Message) error {
+	return recvMessage(c.controlConn, m)
+}
+
+func sendMessage(conn *websocket.Conn, m proto.Message) error {
+	w, err := conn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
 		return err
 	}
@@ -61,8 +149,8 @@ func (c *migrationFields) send(m proto.Message) error {
 	return shared.WriteAll(w, data)
 }
 
-func (c *migrationFields) recv(m proto.Message) error {
-	mt, r, err := c.controlConn.NextReader()
+func recvMessage(conn *websocket.Conn, m proto.Message) error {
+	mt, r, err := conn.NextReader()
 	if err != nil {
 		return err
 	}
@@ -127,6 +215,120 @@ func (c *migrationFields) controlChannel() <-chan MigrationControl {
 	return ch
 }
 
+// secrets returns the secrets of the websockets this end expects.
+func (c *migrationFields) secrets() shared.Jmap {
+	secrets := shared.Jmap{
+		"control": c.controlSecret,
+		"fs":      c.fsSecret,
+	}
+
+	if c.criuSecret != "" {
+		secrets["criu"] = c.criuSecret
+	}
+
+	return secrets
+}
+
+/*
+ * accept upgrades a connection to the websocket matching secret. It returns
+ * true once all the websockets this end expects are connected.
+ */
+func (c *migrationFields) accept(secret string, r *http.Request, w http.ResponseWriter) (bool, error) {
+	var conn **websocket.Conn
+
+	switch secret {
+	case c.controlSecret:
+		conn = &c.controlConn
+	case c.criuSecret:
+		conn = &c.criuConn
+	case c.fsSecret:
+		conn = &c.fsConn
+	default:
+		/* If we didn't find the right secret, the user provided a bad one,
+		 * which 403, not 404, since this operation actually exists */
+		return false, os.ErrPermission
+	}
+
+	ws, err := shared.WebsocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := c.setConn(conn, ws); err != nil {
+		return false, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.controlConn != nil && (!c.live || c.criuConn != nil) && c.fsConn != nil, nil
+}
+
+/*
+ * waitConnected waits for the other end to connect all the websockets,
+ * unless the migration is cancelled meanwhile.
+ */
+func (c *migrationFields) waitConnected(allConnected chan bool) error {
+	select {
+	case <-allConnected:
+		return nil
+	case <-c.cancelled:
+		return fmt.Errorf("Migration cancelled")
+	case <-time.After(connectTimeout):
+		return fmt.Errorf("Timed out waiting for the other end to connect")
+	}
+}
+
+func connectWithSecret(dialer websocket.Dialer, operation string, secret string) (*websocket.Conn, error) {
+	query := url.Values{"secret": []string{secret}}
+
+	// TODO: we shouldn't assume this is a HTTP URL
+	url := operation + "?" + query.Encode()
+
+	return lxd.WebsocketDial(dialer, url)
+}
+
+/*
+ * dial connects all the websockets of the other end's operation, which must
+ * have given us the secrets this end expects.
+ */
+func (c *migrationFields) dial(dialer websocket.Dialer, operation string) error {
+	if dialer.NetDial == nil {
+		dialer.NetDial = func(network string, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, dialTimeout)
+		}
+	}
+
+	ws, err := connectWithSecret(dialer, operation, c.controlSecret)
+	if err == nil {
+		err = c.setConn(&c.controlConn, ws)
+	}
+	if err != nil {
+		return err
+	}
+
+	ws, err = connectWithSecret(dialer, operation, c.fsSecret)
+	if err == nil {
+		err = c.setConn(&c.fsConn, ws)
+	}
+	if err != nil {
+		c.sendControl(err)
+		return err
+	}
+
+	if c.live {
+		ws, err = connectWithSecret(dialer, operation, c.criuSecret)
+		if err == nil {
+			err = c.setConn(&c.criuConn, ws)
+		}
+		if err != nil {
+			c.sendControl(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
 func collectMigrationLogFile(c *lxc.Container, imagesDir string, method string) error {
 	t := time.Now().Format(time.RFC3339)
 	newPath := shared.LogPath(c.Name(), fmt.Sprintf("migration_%s_%s.log", method, t))
@@ -136,88 +338,180 @@ func collectMigrationLogFile(c *lxc.Container, imagesDir string, method string)
 type migrationSourceWs struct {
 	migrationFields
 
-	allConnected chan bool
+	allConnected  chan bool
+	snapshots     []*Snapshot
+	predumpRounds int32
+	predumpGoal   int32
+	idmap         *shared.IdmapSet
+	stopped       func() error
+	restore       func(dir string) error
 }
 
-func NewMigrationSource(c *lxc.Container) (shared.OperationWebsocket, error) {
-	ret := migrationSourceWs{migrationFields{container: c}, make(chan bool, 1)}
+type MigrationSourceArgs struct {
+	Container *lxc.Container
+
+	/* The map the container's files are shifted to, nil if they aren't */
+	Idmap *shared.IdmapSet
+
+	/* The snapshots to send along with the container */
+	Snapshots []*Snapshot
+
+	/*
+	 * For live migrations, the most rounds of pre-copying the container's
+	 * memory to do while it keeps running (0 not to pre-copy), and the
+	 * percentage of its memory which must be left unchanged by a round to
+	 * stop pre-copying.
+	 */
+	PredumpRounds int
+	PredumpGoal   int
+
+	/* Push mode only: the sink's operation and secrets */
+	Url     string
+	Dialer  websocket.Dialer
+	Secrets map[string]string
+
+	/*
+	 * Called once the final dump of a live migration stopped the
+	 * container, to clean up what it used on this host, if set.
+	 */
+	Stopped func() error
+
+	/*
+	 * Called to restore the container from the final dump in dir when the
+	 * migration fails (or is cancelled) after it, if set. The container
+	 * is restored directly if it isn't set.
+	 */
+	Restore func(dir string) error
+
+	/* Called with the progress of the transfers, if set */
+	Progress ProgressFunc
+}
+
+func newMigrationSourceWs(args *MigrationSourceArgs) *migrationSourceWs {
+	return &migrationSourceWs{
+		migrationFields: newMigrationFields(args.Container, false, args.Progress),
+		allConnected:    make(chan bool, 1),
+		snapshots:       args.Snapshots,
+		predumpRounds:   int32(args.PredumpRounds),
+		predumpGoal:     int32(args.PredumpGoal),
+		idmap:           args.Idmap,
+		stopped:         args.Stopped,
+		restore:         args.Restore,
+	}
+}
+
+// NewMigrationSource sets up the source end of a migration, waiting for the
+// sink to connect to it. It also returns a function cancelling it.
+func NewMigrationSource(args *MigrationSourceArgs) (shared.OperationWebsocket, func() error, error) {
+	c := args.Container
+	ret := newMigrationSourceWs(args)
 
 	var err error
 	ret.controlSecret, err = shared.RandomCryptoString()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	ret.fsSecret, err = shared.RandomCryptoString()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if c.Running() {
 		ret.live = true
 		ret.criuSecret, err = shared.RandomCryptoString()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	return &ret, nil
+	return ret, ret.Cancel, nil
 }
 
-func (s *migrationSourceWs) Metadata() interface{} {
-	secrets := shared.Jmap{
-		"control": s.controlSecret,
-		"fs":      s.fsSecret,
+/*
+ * NewMigrationSourcePush returns a function which migrates the container by
+ * connecting out to a sink set up in push mode (see NewMigrationPushSink),
+ * for when the sink can't connect to us, and a function cancelling it.
+ */
+func NewMigrationSourcePush(args *MigrationSourceArgs) (func() shared.OperationResult, func() error, error) {
+	c := args.Container
+	s := newMigrationSourceWs(args)
+
+	var ok bool
+	s.controlSecret, ok = args.Secrets["control"]
+	if !ok {
+		return nil, nil, fmt.Errorf("missing control secret")
 	}
 
-	if s.criuSecret != "" {
-		secrets["criu"] = s.criuSecret
+	s.fsSecret, ok = args.Secrets["fs"]
+	if !ok {
+		return nil, nil, fmt.Errorf("missing fs secret")
 	}
 
-	return secrets
-}
+	s.criuSecret, s.live = args.Secrets["criu"]
+	if s.live != c.Running() {
+		if s.live {
+			return nil, nil, fmt.Errorf("The container isn't running, it can't be live migrated")
+		}
+		return nil, nil, fmt.Errorf("The container is running but the target doesn't expect a live migration")
+	}
 
-func (s *migrationSourceWs) Connect(secret string, r *http.Request, w http.ResponseWriter) error {
-	var conn **websocket.Conn
+	run := func() shared.OperationResult {
+		if err := s.dial(args.Dialer, args.Url); err != nil {
+			return shared.OperationError(err)
+		}
 
-	switch secret {
-	case s.controlSecret:
-		conn = &s.controlConn
-	case s.criuSecret:
-		conn = &s.criuConn
-	case s.fsSecret:
-		conn = &s.fsConn
-	default:
-		/* If we didn't find the right secret, the user provided a bad one,
-		 * which 403, not 404, since this operation actually exists */
-		return os.ErrPermission
+		s.allConnected <- true
+		return s.Do()
 	}
 
-	c, err := shared.WebsocketUpgrader.Upgrade(w, r, nil)
+	return run, s.Cancel, nil
+}
+
+func (s *migrationSourceWs) Metadata() interface{} {
+	return s.secrets()
+}
+
+func (s *migrationSourceWs) Connect(secret string, r *http.Request, w http.ResponseWriter) error {
+	connected, err := s.accept(secret, r, w)
 	if err != nil {
 		return err
 	}
 
-	*conn = c
-
-	if s.controlConn != nil && (!s.live || s.criuConn != nil) && s.fsConn != nil {
+	if connected {
 		s.allConnected <- true
 	}
 
 	return nil
 }
 
-func (s *migrationSourceWs) Do() shared.OperationResult {
-	<-s.allConnected
+func (s *migrationSourceWs) Do() (result shared.OperationResult) {
+	if err := s.waitConnected(s.allConnected); err != nil {
+		s.disconnect()
+		return shared.OperationError(err)
+	}
 
 	criuType := CRIUType_CRIU_RSYNC.Enum()
 	if !s.live {
 		criuType = nil
 	}
 
+	fsDir := shared.VarPath("lxc", s.container.Name())
+	fsType := sendFSType(fsDir, s.snapshots)
+
 	header := MigrationHeader{
-		Fs:   MigrationFSType_RSYNC.Enum(),
-		Criu: criuType,
+		Fs:        fsType.Enum(),
+		Criu:      criuType,
+		Snapshots: s.snapshots,
+	}
+
+	if s.idmap != nil {
+		header.Idmap = s.idmap.Entries()
+	}
+
+	if s.live && s.predumpRounds > 0 {
+		header.PredumpRounds = proto.Int32(s.predumpRounds)
+		header.PredumpGoal = proto.Int32(s.predumpGoal)
 	}
 
 	if err := s.send(&header); err != nil {
@@ -230,8 +524,9 @@ func (s *migrationSourceWs) Do() shared.OperationResult {
 		return shared.OperationError(err)
 	}
 
-	if *header.Fs != MigrationFSType_RSYNC {
-		err := fmt.Errorf("formats other than rsync not understood")
+	/* The sink either takes what we proposed, or falls back to rsync */
+	if header.GetFs() != fsType && header.GetFs() != MigrationFSType_RSYNC {
+		err := fmt.Errorf("The target asked for a %s transfer, but %s was proposed", header.GetFs(), fsType)
 		s.sendControl(err)
 		return shared.OperationError(err)
 	}
@@ -254,11 +549,40 @@ func (s *migrationSourceWs) Do() shared.OperationResult {
 		}
 		defer os.RemoveAll(checkpointDir)
 
-		opts := lxc.CheckpointOptions{Stop: true, Directory: checkpointDir, Verbose: true}
-		err = s.container.Checkpoint(opts)
+		/*
+		 * Once the final dump stopped the container, it's brought back
+		 * here if the migration fails, from that dump (before it's
+		 * removed).
+		 */
+		dumped := false
+		dumpDir := checkpointDir
+		defer func() {
+			if dumped && result.Error != nil {
+				if err := s.restoreLocally(dumpDir); err != nil {
+					shared.Debugf("error restoring %s after the failed migration: %s", s.container.Name(), err)
+				}
+			}
+		}()
+
+		/*
+		 * An older sink doesn't send the pre-copy settings back, in which
+		 * case we just do a single dump.
+		 */
+		predumpDir := ""
+		if header.GetPredumpRounds() > 0 {
+			predumpDir, err = s.preDump(checkpointDir, header.GetPredumpRounds(), header.GetPredumpGoal())
+			if err != nil {
+				s.sendControl(err)
+				return shared.OperationError(err)
+			}
+
+			dumpDir = filepath.Join(checkpointDir, "final")
+		}
+
+		err = s.dump(dumpDir, predumpDir)
 
-		if err2 := collectMigrationLogFile(s.container, checkpointDir, "dump"); err2 != nil {
-			shared.Debugf("error collecting checkpoint log file %s", err)
+		if err2 := collectMigrationLogFile(s.container, dumpDir, "dump"); err2 != nil {
+			shared.Debugf("error collecting checkpoint log file %s", err2)
 		}
 
 		if err != nil {
@@ -266,6 +590,21 @@ func (s *migrationSourceWs) Do() shared.OperationResult {
 			return shared.OperationError(err)
 		}
 
+		/* From here on, the container is stopped */
+		dumped = true
+		if s.stopped != nil {
+			if err := s.stopped(); err != nil {
+				shared.Debugf("error cleaning up after stopping %s: %s", s.container.Name(), err)
+			}
+		}
+
+		if predumpDir != "" {
+			if err := sendMessage(s.criuConn, &MigrationRound{Final: proto.Bool(true)}); err != nil {
+				s.sendControl(err)
+				return shared.OperationError(err)
+			}
+		}
+
 		/*
 		 * We do the serially right now, but there's really no reason for us
 		 * to; since we have separate websockets, we can do it in parallel if
@@ -273,14 +612,17 @@ func (s *migrationSourceWs) Do() shared.OperationResult {
 		 * no reason to do these in parallel. In the future when we're using
 		 * p.haul's protocol, it will make sense to do these in parallel.
 		 */
-		if err := RsyncSend(AddSlash(checkpointDir), s.criuConn); err != nil {
+		err = rsyncSend(AddSlash(checkpointDir), s.criuConn, s.criuProgress)
+		s.criuProgress.done()
+		if err != nil {
 			s.sendControl(err)
 			return shared.OperationError(err)
 		}
 	}
 
-	fsDir := s.container.ConfigItem("lxc.rootfs")[0]
-	if err := RsyncSend(AddSlash(fsDir), s.fsConn); err != nil {
+	err := fsSend(header.GetFs(), fsDir, s.snapshots, s.fsConn, s.fsProgress)
+	s.fsProgress.done()
+	if err != nil {
 		s.sendControl(err)
 		return shared.OperationError(err)
 	}
@@ -291,8 +633,6 @@ func (s *migrationSourceWs) Do() shared.OperationResult {
 		return shared.OperationError(err)
 	}
 
-	// TODO: should we add some config here about automatically restarting
-	// the container migrate failure? What about the failures above?
 	if !*msg.Success {
 		return shared.OperationError(fmt.Errorf(*msg.Message))
 	}
@@ -300,12 +640,131 @@ func (s *migrationSourceWs) Do() shared.OperationResult {
 	return shared.OperationSuccess
 }
 
+// restoreLocally restores the container from the final dump in dir.
+func (s *migrationSourceWs) restoreLocally(dir string) error {
+	if s.restore != nil {
+		return s.restore(dir)
+	}
+
+	return s.container.Restore(lxc.RestoreOptions{Directory: dir, Verbose: true})
+}
+
+// dump does the final dump of the container, stopping it.
+func (s *migrationSourceWs) dump(dir string, predumpDir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	if predumpDir == "" {
+		opts := lxc.CheckpointOptions{Stop: true, Directory: dir, Verbose: true}
+		return s.container.Checkpoint(opts)
+	}
+
+	opts := lxc.MigrateOptions{
+		Directory:  dir,
+		PredumpDir: filepath.Join("..", predumpDir),
+		Stop:       true,
+		Verbose:    true,
+	}
+
+	return s.container.Migrate(lxc.MIGRATE_DUMP, opts)
+}
+
+/*
+ * predumpSize is the size of the memory pages a CRIU dump or pre-dump wrote
+ * out.
+ */
+func predumpSize(dir string) (int64, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "pages-*.img"))
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+
+	return size, nil
+}
+
+// predumpConverged tells whether a round dumped so little of the memory the
+// first round did that pre-copying more isn't worth it.
+func predumpConverged(first int64, size int64, goal int32) bool {
+	return size*100 <= first*int64(100-goal)
+}
+
+/*
+ * preDump copies the container's memory to the sink while it keeps running,
+ * each round only sending what changed since the previous one, until a
+ * round leaves enough of the memory unchanged or there were enough rounds.
+ * It returns the directory (relative to checkpointDir) of the last round,
+ * for the final dump to start from.
+ */
+func (s *migrationSourceWs) preDump(checkpointDir string, rounds int32, goal int32) (string, error) {
+	var first int64
+	prev := ""
+
+	for i := int32(0); i < rounds; i++ {
+		dir := fmt.Sprintf("predump%d", i)
+		if err := os.MkdirAll(filepath.Join(checkpointDir, dir), 0700); err != nil {
+			return "", err
+		}
+
+		opts := lxc.MigrateOptions{Directory: filepath.Join(checkpointDir, dir), Verbose: true}
+		if prev != "" {
+			opts.PredumpDir = filepath.Join("..", prev)
+		}
+
+		/*
+		 * If CRIU can't pre-dump, the final dump still works, it just
+		 * has everything to dump.
+		 */
+		if err := s.container.Migrate(lxc.MIGRATE_PRE_DUMP, opts); err != nil {
+			shared.Debugf("pre-dump round %d failed, doing the final dump: %s", i, err)
+			os.RemoveAll(filepath.Join(checkpointDir, dir))
+			break
+		}
+		prev = dir
+
+		if err := sendMessage(s.criuConn, &MigrationRound{Final: proto.Bool(false)}); err != nil {
+			return "", err
+		}
+
+		if err := rsyncSendRound(AddSlash(checkpointDir), s.criuConn, s.criuProgress); err != nil {
+			return "", err
+		}
+
+		size, err := predumpSize(filepath.Join(checkpointDir, dir))
+		if err != nil {
+			return "", err
+		}
+
+		if i == 0 {
+			first = size
+		} else if predumpConverged(first, size, goal) {
+			break
+		}
+	}
+
+	return prev, nil
+}
+
 type migrationSink struct {
 	migrationFields
 
-	url    string
-	dialer websocket.Dialer
-	idMap  *shared.Idmap
+	url            string
+	dialer         websocket.Dialer
+	idmap          *shared.IdmapSet
+	createSnapshot func(snapshot *Snapshot) error
+	restore        func(dir string) error
+
+	/* Only used in push mode */
+	allConnected chan bool
 }
 
 type MigrationSinkArgs struct {
@@ -313,80 +772,206 @@ type MigrationSinkArgs struct {
 	Dialer    websocket.Dialer
 	Container *lxc.Container
 	Secrets   map[string]string
-	IdMap     *shared.Idmap
+
+	/* The map the container runs with here, nil if it's privileged */
+	Idmap *shared.IdmapSet
+
+	/* In push mode, whether the source will live migrate the container */
+	Live bool
+
+	/*
+	 * Called for each of the snapshots the source sent, once they're
+	 * received.
+	 */
+	CreateSnapshot func(snapshot *Snapshot) error
+
+	/*
+	 * For live migrations, called to restore the container from the
+	 * received dump in dir, setting up what it needs on this host. The
+	 * container is restored directly if it isn't set.
+	 */
+	Restore func(dir string) error
+
+	/* Called with the progress of the transfers, if set */
+	Progress ProgressFunc
 }
 
-func NewMigrationSink(args *MigrationSinkArgs) (func() error, error) {
-	sink := migrationSink{
-		migrationFields{container: args.Container},
-		args.Url,
-		args.Dialer,
-		args.IdMap,
+/*
+ * NewMigrationSink returns a function which migrates the container by
+ * connecting to the source, and a function cancelling it.
+ */
+func NewMigrationSink(args *MigrationSinkArgs) (func() error, func() error, error) {
+	sink := &migrationSink{
+		migrationFields: newMigrationFields(args.Container, false, args.Progress),
+		url:             args.Url,
+		dialer:          args.Dialer,
+		idmap:           args.Idmap,
+		createSnapshot:  args.CreateSnapshot,
+		restore:         args.Restore,
 	}
 
 	var ok bool
 	sink.controlSecret, ok = args.Secrets["control"]
 	if !ok {
-		return nil, fmt.Errorf("missing control secret")
+		return nil, nil, fmt.Errorf("missing control secret")
 	}
 
 	sink.fsSecret, ok = args.Secrets["fs"]
 	if !ok {
-		return nil, fmt.Errorf("missing fs secret")
+		return nil, nil, fmt.Errorf("missing fs secret")
 	}
 
 	sink.criuSecret, ok = args.Secrets["criu"]
 	sink.live = ok
 
-	return sink.do, nil
+	return sink.do, sink.Cancel, nil
 }
 
-func (c *migrationSink) connectWithSecret(secret string) (*websocket.Conn, error) {
+/*
+ * NewMigrationPushSink returns a sink which, instead of connecting to the
+ * source, waits for the source to connect to it (see
+ * NewMigrationSourcePush). This is for sources which can only dial out.
+ * It also returns a function cancelling it.
+ */
+func NewMigrationPushSink(args *MigrationSinkArgs) (shared.OperationWebsocket, func() error, error) {
+	sink := &migrationSink{
+		migrationFields: newMigrationFields(args.Container, args.Live, args.Progress),
+		idmap:           args.Idmap,
+		createSnapshot:  args.CreateSnapshot,
+		restore:         args.Restore,
+		allConnected:    make(chan bool, 1),
+	}
 
-	query := url.Values{"secret": []string{secret}}
+	var err error
+	sink.controlSecret, err = shared.RandomCryptoString()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// TODO: we shouldn't assume this is a HTTP URL
-	url := c.url + "?" + query.Encode()
+	sink.fsSecret, err = shared.RandomCryptoString()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sink.live {
+		sink.criuSecret, err = shared.RandomCryptoString()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
-	return lxd.WebsocketDial(c.dialer, url)
+	return sink, sink.Cancel, nil
 }
 
-func (c *migrationSink) do() error {
-	var err error
-	c.controlConn, err = c.connectWithSecret(c.controlSecret)
+func (c *migrationSink) Metadata() interface{} {
+	return c.secrets()
+}
+
+func (c *migrationSink) Connect(secret string, r *http.Request, w http.ResponseWriter) error {
+	connected, err := c.accept(secret, r, w)
 	if err != nil {
 		return err
 	}
+
+	if connected {
+		c.allConnected <- true
+	}
+
+	return nil
+}
+
+func (c *migrationSink) Do() shared.OperationResult {
 	defer c.disconnect()
 
-	c.fsConn, err = c.connectWithSecret(c.fsSecret)
-	if err != nil {
-		c.sendControl(err)
+	if err := c.waitConnected(c.allConnected); err != nil {
+		return shared.OperationError(err)
+	}
+
+	return shared.OperationError(c.transfer())
+}
+
+func (c *migrationSink) do() error {
+	if err := c.dial(c.dialer, c.url); err != nil {
+		/* Tell the client when it may try the other way around */
+		if _, ok := err.(net.Error); ok && c.controlConn == nil {
+			return fmt.Errorf("%s: %s", shared.MigrationUnreachable, err)
+		}
+
 		return err
 	}
+	defer c.disconnect()
 
-	if c.live {
-		c.criuConn, err = c.connectWithSecret(c.criuSecret)
-		if err != nil {
-			c.sendControl(err)
+	return c.transfer()
+}
+
+/*
+ * recvPredumps receives the pre-copy rounds into imagesDir, up to the
+ * source saying the final dump comes next.
+ */
+func (c *migrationSink) recvPredumps(imagesDir string) error {
+	for {
+		round := MigrationRound{}
+		if err := recvMessage(c.criuConn, &round); err != nil {
+			return err
+		}
+
+		if round.GetFinal() {
+			return nil
+		}
+
+		if err := rsyncRecvRound(AddSlash(imagesDir), c.criuConn, c.criuProgress); err != nil {
 			return err
 		}
 	}
+}
+
+/*
+ * transfer receives the container once all the websockets are connected,
+ * whichever end connected them.
+ */
+func (c *migrationSink) transfer() error {
+	var err error
 
-	// For now, we just ignore whatever the server sends us. We only
-	// support RSYNC, so that's what we respond with.
 	header := MigrationHeader{}
 	if err := c.recv(&header); err != nil {
 		c.sendControl(err)
 		return err
 	}
 
+	if err := checkSnapshotNames(header.GetSnapshots()); err != nil {
+		c.sendControl(err)
+		return err
+	}
+
+	sourceIdmap, err := headerIdmap(&header)
+	if err != nil {
+		c.sendControl(err)
+		return err
+	}
+
+	if err := checkIdmapSize(sourceIdmap, c.idmap); err != nil {
+		c.sendControl(err)
+		return err
+	}
+
 	criuType := CRIUType_CRIU_RSYNC.Enum()
 	if !c.live {
 		criuType = nil
 	}
 
-	resp := MigrationHeader{Fs: MigrationFSType_RSYNC.Enum(), Criu: criuType}
+	/*
+	 * If the source proposed a native btrfs stream and we're on the same
+	 * filesystem, we take it, otherwise we fall back to rsync.
+	 */
+	fsType := recvFSType(header.GetFs(), shared.VarPath("lxc"))
+	resp := MigrationHeader{Fs: fsType.Enum(), Criu: criuType}
+
+	/* We can take pre-copy rounds, so agree to the source's settings */
+	predump := c.live && header.GetPredumpRounds() > 0
+	if predump {
+		resp.PredumpRounds = header.PredumpRounds
+		resp.PredumpGoal = header.PredumpGoal
+	}
 	if err := c.send(&resp); err != nil {
 		c.sendControl(err)
 		return err
@@ -395,6 +980,7 @@ func (c *migrationSink) do() error {
 	restore := make(chan error)
 	go func(c *migrationSink) {
 		imagesDir := ""
+		restoreDir := ""
 		if c.live {
 			var err error
 			imagesDir, err = ioutil.TempDir("", "lxd_migration_")
@@ -404,8 +990,17 @@ func (c *migrationSink) do() error {
 				return
 			}
 
+			/*
+			 * When pre-copying, the source sends the pre-copy rounds, then
+			 * the final dump in the final directory.
+			 */
+			restoreDir = imagesDir
+			if predump {
+				restoreDir = filepath.Join(imagesDir, "final")
+			}
+
 			defer func() {
-				err := collectMigrationLogFile(c.container, imagesDir, "restore")
+				err := collectMigrationLogFile(c.container, restoreDir, "restore")
 				/*
 				 * If the checkpoint fails, we won't have any log to collect,
 				 * so don't warn about that.
@@ -417,7 +1012,17 @@ func (c *migrationSink) do() error {
 				os.RemoveAll(imagesDir)
 			}()
 
-			if err := RsyncRecv(AddSlash(imagesDir), c.criuConn); err != nil {
+			if predump {
+				if err := c.recvPredumps(imagesDir); err != nil {
+					restore <- err
+					c.sendControl(err)
+					return
+				}
+			}
+
+			err = rsyncWebsocket(rsyncRecvCmd(AddSlash(imagesDir)), c.criuConn, c.criuProgress)
+			c.criuProgress.done()
+			if err != nil {
 				restore <- err
 				os.RemoveAll(imagesDir)
 				c.sendControl(err)
@@ -425,21 +1030,41 @@ func (c *migrationSink) do() error {
 			}
 		}
 
-		fsDir := c.container.ConfigItem("lxc.rootfs")[0]
-		if err := RsyncRecv(AddSlash(fsDir), c.fsConn); err != nil {
+		/*
+		 * The source sends the container's directory, with the rootfs
+		 * and the snapshots in it.
+		 */
+		fsDir := shared.VarPath("lxc", c.container.Name())
+		err := fsRecv(fsType, fsDir, header.GetSnapshots(), c.fsConn, c.fsProgress)
+		c.fsProgress.done()
+		if err != nil {
 			restore <- err
 			c.sendControl(err)
 			return
 		}
 
-		if err := c.idMap.ShiftRootfs(shared.VarPath("lxc", c.container.Name())); err != nil {
+		if err := remapIdmap(fsDir, header.GetSnapshots(), sourceIdmap, c.idmap); err != nil {
 			restore <- err
 			c.sendControl(err)
 			return
 		}
 
-		if c.live {
-			opts := lxc.RestoreOptions{Directory: imagesDir, Verbose: true}
+		for _, snap := range header.GetSnapshots() {
+			if c.createSnapshot == nil {
+				break
+			}
+
+			if err := c.createSnapshot(snap); err != nil {
+				restore <- err
+				c.sendControl(err)
+				return
+			}
+		}
+
+		if c.live && c.restore != nil {
+			restore <- c.restore(restoreDir)
+		} else if c.live {
+			opts := lxc.RestoreOptions{Directory: restoreDir, Verbose: true}
 			restore <- c.container.Restore(opts)
 		} else {
 			restore <- nil
@@ -470,3 +1095,100 @@ func (c *migrationSink) do() error {
 		}
 	}
 }
+
+/*
+ * checkSnapshotNames makes sure the names of the snapshots the source is
+ * sending can be used in paths, before anything is received.
+ */
+func checkSnapshotNames(snapshots []*Snapshot) error {
+	seen := map[string]bool{}
+	for _, snap := range snapshots {
+		name := snap.GetName()
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("Invalid snapshot name: %q", name)
+		}
+
+		if seen[name] {
+			return fmt.Errorf("Snapshot %q sent twice", name)
+		}
+		seen[name] = true
+	}
+
+	return nil
+}
+
+/*
+ * headerIdmap returns the map the source's files are shifted to, nil if it
+ * didn't send one, as for privileged containers (or from an older LXD).
+ */
+func headerIdmap(header *MigrationHeader) (*shared.IdmapSet, error) {
+	if len(header.GetIdmap()) == 0 {
+		return nil, nil
+	}
+
+	set := shared.IdmapSet{}
+	for _, entry := range header.GetIdmap() {
+		var err error
+		set, err = set.Append(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &set, nil
+}
+
+/*
+ * checkIdmapSize makes sure the map the container gets here has room for
+ * all the ids it had on the source.
+ */
+func checkIdmapSize(source *shared.IdmapSet, target *shared.IdmapSet) error {
+	if source == nil || target == nil {
+		return nil
+	}
+
+	sourceUids, sourceGids := source.Ranges()
+	uids, gids := target.Ranges()
+	if uids < sourceUids || gids < sourceGids {
+		return fmt.Errorf("The container would get %d uids and %d gids here, fewer than the %d uids and %d gids it has on the source; update its profile here or give it another one", uids, gids, sourceUids, sourceGids)
+	}
+
+	return nil
+}
+
+/*
+ * remapIdmap shifts the root filesystems of the container in path and of
+ * the snapshots sent along from the source's map to ours: back to the ids
+ * in the container, then to ours. There's nothing to do if both are the
+ * same.
+ */
+func remapIdmap(path string, snapshots []*Snapshot, source *shared.IdmapSet, target *shared.IdmapSet) error {
+	if source == nil && target == nil {
+		return nil
+	}
+
+	if source != nil && target != nil && source.Equals(*target) {
+		return nil
+	}
+
+	rootfs := []string{filepath.Join(path, "rootfs")}
+	for _, snap := range snapshots {
+		rootfs = append(rootfs, filepath.Join(path, "snapshots", snap.GetName(), "rootfs"))
+	}
+
+	for _, p := range rootfs {
+		if source != nil {
+			if err := shared.Uidshift(p, source.Reverse(), false); err != nil {
+				return err
+			}
+		}
+
+		if target != nil {
+			if err := shared.Uidshift(p, *target, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -85,10 +85,124 @@ func (x *CRIUType) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type Config struct {
+	Key              *string `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	Value            *string `protobuf:"bytes,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Config) Reset()         { *m = Config{} }
+func (m *Config) String() string { return proto.CompactTextString(m) }
+func (*Config) ProtoMessage()    {}
+
+func (m *Config) GetKey() string {
+	if m != nil && m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *Config) GetValue() string {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
+type Device struct {
+	Name             *string   `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	Config           []*Config `protobuf:"bytes,2,rep,name=config" json:"config,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *Device) Reset()         { *m = Device{} }
+func (m *Device) String() string { return proto.CompactTextString(m) }
+func (*Device) ProtoMessage()    {}
+
+func (m *Device) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *Device) GetConfig() []*Config {
+	if m != nil {
+		return m.Config
+	}
+	return nil
+}
+
+type Snapshot struct {
+	Name             *string   `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	Config           []*Config `protobuf:"bytes,2,rep,name=config" json:"config,omitempty"`
+	Profiles         []string  `protobuf:"bytes,3,rep,name=profiles" json:"profiles,omitempty"`
+	Ephemeral        *bool     `protobuf:"varint,4,req,name=ephemeral" json:"ephemeral,omitempty"`
+	Devices          []*Device `protobuf:"bytes,5,rep,name=devices" json:"devices,omitempty"`
+	Stateful         *bool     `protobuf:"varint,6,req,name=stateful" json:"stateful,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *Snapshot) Reset()         { *m = Snapshot{} }
+func (m *Snapshot) String() string { return proto.CompactTextString(m) }
+func (*Snapshot) ProtoMessage()    {}
+
+func (m *Snapshot) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *Snapshot) GetConfig() []*Config {
+	if m != nil {
+		return m.Config
+	}
+	return nil
+}
+
+func (m *Snapshot) GetProfiles() []string {
+	if m != nil {
+		return m.Profiles
+	}
+	return nil
+}
+
+func (m *Snapshot) GetEphemeral() bool {
+	if m != nil && m.Ephemeral != nil {
+		return *m.Ephemeral
+	}
+	return false
+}
+
+func (m *Snapshot) GetDevices() []*Device {
+	if m != nil {
+		return m.Devices
+	}
+	return nil
+}
+
+func (m *Snapshot) GetStateful() bool {
+	if m != nil && m.Stateful != nil {
+		return *m.Stateful
+	}
+	return false
+}
+
 type MigrationHeader struct {
-	Fs               *MigrationFSType `protobuf:"varint,1,req,name=fs,enum=migration.MigrationFSType" json:"fs,omitempty"`
-	Criu             *CRIUType        `protobuf:"varint,2,opt,name=criu,enum=migration.CRIUType" json:"criu,omitempty"`
-	XXX_unrecognized []byte           `json:"-"`
+	Fs        *MigrationFSType `protobuf:"varint,1,req,name=fs,enum=migration.MigrationFSType" json:"fs,omitempty"`
+	Criu      *CRIUType        `protobuf:"varint,2,opt,name=criu,enum=migration.CRIUType" json:"criu,omitempty"`
+	Snapshots []*Snapshot      `protobuf:"bytes,3,rep,name=snapshots" json:"snapshots,omitempty"`
+	// Live migrations only: the most pre-copy rounds to do, and the
+	// percentage of the memory which must be left unchanged by a round to
+	// stop pre-copying. The source proposes, the sink agrees by sending the
+	// same values back.
+	PredumpRounds *int32 `protobuf:"varint,4,opt,name=predumpRounds" json:"predumpRounds,omitempty"`
+	PredumpGoal   *int32 `protobuf:"varint,5,opt,name=predumpGoal" json:"predumpGoal,omitempty"`
+	// The map the container's files are shifted to on the source, as the
+	// entries of a shared.IdmapSet. None for privileged containers.
+	Idmap            []string `protobuf:"bytes,6,rep,name=idmap" json:"idmap,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (m *MigrationHeader) Reset()         { *m = MigrationHeader{} }
@@ -109,6 +223,52 @@ func (m *MigrationHeader) GetCriu() CRIUType {
 	return 0
 }
 
+func (m *MigrationHeader) GetSnapshots() []*Snapshot {
+	if m != nil {
+		return m.Snapshots
+	}
+	return nil
+}
+
+func (m *MigrationHeader) GetPredumpRounds() int32 {
+	if m != nil && m.PredumpRounds != nil {
+		return *m.PredumpRounds
+	}
+	return 0
+}
+
+func (m *MigrationHeader) GetPredumpGoal() int32 {
+	if m != nil && m.PredumpGoal != nil {
+		return *m.PredumpGoal
+	}
+	return 0
+}
+
+func (m *MigrationHeader) GetIdmap() []string {
+	if m != nil {
+		return m.Idmap
+	}
+	return nil
+}
+
+// Sent over the criu channel before each transfer when pre-copying: a
+// pre-copy round, or the final dump.
+type MigrationRound struct {
+	Final            *bool  `protobuf:"varint,1,req,name=final" json:"final,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *MigrationRound) Reset()         { *m = MigrationRound{} }
+func (m *MigrationRound) String() string { return proto.CompactTextString(m) }
+func (*MigrationRound) ProtoMessage()    {}
+
+func (m *MigrationRound) GetFinal() bool {
+	if m != nil && m.Final != nil {
+		return *m.Final
+	}
+	return false
+}
+
 type MigrationControl struct {
 	Success *bool `protobuf:"varint,1,req,name=success" json:"success,omitempty"`
 	// optional failure message if sending a failure
@@ -0,0 +1,183 @@
+package migration
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/lxc/lxd/shared"
+)
+
+func TestPredumpConverged(t *testing.T) {
+	tests := []struct {
+		first    int64
+		size     int64
+		goal     int32
+		expected bool
+	}{
+		{1000, 800, 70, false},
+		{1000, 300, 70, true},
+		{1000, 301, 70, false},
+		{1000, 0, 100, true},
+		{1000, 1, 100, false},
+		{0, 0, 70, true},
+	}
+
+	for _, test := range tests {
+		if predumpConverged(test.first, test.size, test.goal) != test.expected {
+			t.Errorf("predumpConverged(%d, %d, %d) should be %v", test.first, test.size, test.goal, test.expected)
+		}
+	}
+}
+
+func testIdmapSet(t *testing.T, base int, size int) *shared.IdmapSet {
+	header := MigrationHeader{Idmap: []string{
+		fmt.Sprintf("u:0:%d:%d", base, size),
+		fmt.Sprintf("g:0:%d:%d", base, size),
+	}}
+
+	set, err := headerIdmap(&header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return set
+}
+
+func TestCheckSnapshotNames(t *testing.T) {
+	snaps := []*Snapshot{{Name: proto.String("snap0")}, {Name: proto.String(".snap1")}}
+	if err := checkSnapshotNames(snaps); err != nil {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"", ".", "..", "a/b", "snap0"} {
+		bad := append(snaps, &Snapshot{Name: proto.String(name)})
+		if err := checkSnapshotNames(bad); err == nil {
+			t.Errorf("snapshot name %q should be rejected", name)
+		}
+	}
+}
+
+func TestHeaderIdmap(t *testing.T) {
+	set, err := headerIdmap(&MigrationHeader{})
+	if err != nil || set != nil {
+		t.Errorf("expected no map without entries, got %v %v", set, err)
+	}
+
+	set = testIdmapSet(t, 100000, 65536)
+	if strings.Join(set.Entries(), " ") != "u:0:100000:65536 g:0:100000:65536" {
+		t.Errorf("unexpected entries %v", set.Entries())
+	}
+
+	if _, err := headerIdmap(&MigrationHeader{Idmap: []string{"x:0:1"}}); err == nil {
+		t.Error("a bad entry should be rejected")
+	}
+}
+
+func TestCheckIdmapSize(t *testing.T) {
+	if err := checkIdmapSize(testIdmapSet(t, 100000, 65536), testIdmapSet(t, 200000, 65536)); err != nil {
+		t.Error(err)
+	}
+
+	if err := checkIdmapSize(testIdmapSet(t, 100000, 65536), testIdmapSet(t, 200000, 131072)); err != nil {
+		t.Error(err)
+	}
+
+	if err := checkIdmapSize(testIdmapSet(t, 100000, 131072), testIdmapSet(t, 200000, 65536)); err == nil {
+		t.Error("a smaller map on the target should be rejected")
+	}
+
+	if err := checkIdmapSize(nil, testIdmapSet(t, 200000, 65536)); err != nil {
+		t.Error(err)
+	}
+}
+
+var testSecrets = map[string]string{"control": "control", "fs": "fs"}
+
+func TestSinkUnreachable(t *testing.T) {
+	/* A port nothing listens on */
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	do, _, err := NewMigrationSink(&MigrationSinkArgs{Url: "ws://" + addr + "/websocket", Secrets: testSecrets})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = do()
+	if err == nil || !strings.HasPrefix(err.Error(), shared.MigrationUnreachable) {
+		t.Errorf("Bad error for an unreachable source: %v", err)
+	}
+
+	/* A source which is there but refuses the sink isn't unreachable */
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	do, _, err = NewMigrationSink(&MigrationSinkArgs{Url: "ws" + strings.TrimPrefix(server.URL, "http"), Secrets: testSecrets})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = do()
+	if err == nil || strings.HasPrefix(err.Error(), shared.MigrationUnreachable) {
+		t.Errorf("Bad error for a source refusing the sink: %v", err)
+	}
+}
+
+func TestPushConnect(t *testing.T) {
+	ws, cancel, err := NewMigrationPushSink(&MigrationSinkArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	sink := ws.(*migrationSink)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := sink.Connect(r.FormValue("secret"), r, w); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	secrets := map[string]string{}
+	for k, v := range sink.Metadata().(shared.Jmap) {
+		secrets[k] = v.(string)
+	}
+
+	if _, ok := secrets["criu"]; ok {
+		t.Error("A criu secret was given for a migration which isn't live")
+	}
+
+	/* What NewMigrationSourcePush's run does before the transfer */
+	source := newMigrationSourceWs(&MigrationSourceArgs{})
+	source.controlSecret = secrets["control"]
+	source.fsSecret = secrets["fs"]
+	defer source.Cancel()
+
+	if err := source.dial(websocket.Dialer{}, "ws"+strings.TrimPrefix(server.URL, "http")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.waitConnected(sink.allConnected); err != nil {
+		t.Fatal(err)
+	}
+
+	/* A source with the wrong secrets is refused */
+	source = newMigrationSourceWs(&MigrationSourceArgs{})
+	source.controlSecret = "wrong"
+	source.fsSecret = secrets["fs"]
+	if err := source.dial(websocket.Dialer{}, "ws"+strings.TrimPrefix(server.URL, "http")); err == nil {
+		t.Error("A source with the wrong secret connected")
+	}
+}
@@ -0,0 +1,115 @@
+package migration
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress is how far the transfer over one of the channels went.
+type Progress struct {
+	Bytes          int64 `json:"bytes"`
+	BytesPerSecond int64 `json:"bytes_per_second"`
+}
+
+/*
+ * ProgressFunc is called with the progress of the transfer over a channel
+ * ("fs" or "criu") as it goes, at most once a second, and once it's done.
+ */
+type ProgressFunc func(channel string, progress Progress)
+
+/*
+ * progressTracker counts the bytes going over a channel, both ways. A nil
+ * *progressTracker counts nothing.
+ */
+type progressTracker struct {
+	lock    sync.Mutex
+	channel string
+	report  ProgressFunc
+	start   time.Time
+	last    time.Time
+	bytes   int64
+}
+
+func newProgressTracker(channel string, report ProgressFunc) *progressTracker {
+	if report == nil {
+		return nil
+	}
+
+	now := time.Now()
+	return &progressTracker{channel: channel, report: report, start: now, last: now}
+}
+
+func (p *progressTracker) add(n int, force bool) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	p.bytes += int64(n)
+
+	now := time.Now()
+	if !force && now.Sub(p.last) < time.Second {
+		p.lock.Unlock()
+		return
+	}
+	p.last = now
+
+	progress := Progress{Bytes: p.bytes}
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		progress.BytesPerSecond = int64(float64(p.bytes) / elapsed)
+	}
+	p.lock.Unlock()
+
+	p.report(p.channel, progress)
+}
+
+// done reports the progress of a finished transfer.
+func (p *progressTracker) done() {
+	p.add(0, true)
+}
+
+type progressReader struct {
+	io.Reader
+	tracker *progressTracker
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.tracker.add(n, false)
+	return n, err
+}
+
+type progressWriter struct {
+	io.WriteCloser
+	tracker *progressTracker
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	w.tracker.add(n, false)
+	return n, err
+}
+
+/* mirrorRound only closes the writing half of sockets, keep it that way */
+func (w *progressWriter) CloseWrite() error {
+	return closeWrite(w.WriteCloser)
+}
+
+// reader counts what's read from r.
+func (p *progressTracker) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+
+	return &progressReader{Reader: r, tracker: p}
+}
+
+// writer counts what's written to w.
+func (p *progressTracker) writer(w io.WriteCloser) io.WriteCloser {
+	if p == nil {
+		return w
+	}
+
+	return &progressWriter{WriteCloser: w, tracker: p}
+}
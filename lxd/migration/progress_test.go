@@ -0,0 +1,50 @@
+package migration
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestProgressTracker(t *testing.T) {
+	reports := []Progress{}
+	tracker := newProgressTracker("fs", func(channel string, progress Progress) {
+		if channel != "fs" {
+			t.Errorf("expected channel fs got %s", channel)
+		}
+		reports = append(reports, progress)
+	})
+
+	if _, err := ioutil.ReadAll(tracker.reader(strings.NewReader("sent"))); err != nil {
+		t.Fatal(err)
+	}
+
+	w := tracker.writer(&bufferCloser{})
+	if _, err := w.Write([]byte("received")); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.done()
+
+	if len(reports) == 0 {
+		t.Fatal("done didn't report the progress")
+	}
+
+	if last := reports[len(reports)-1]; last.Bytes != int64(len("sent")+len("received")) {
+		t.Errorf("expected %d bytes got %d", len("sent")+len("received"), last.Bytes)
+	}
+}
+
+func TestProgressTrackerNil(t *testing.T) {
+	tracker := newProgressTracker("fs", nil)
+	if tracker != nil {
+		t.Fatal("expected no tracker without a report function")
+	}
+
+	r := strings.NewReader("sent")
+	if tracker.reader(r) != r {
+		t.Error("expected the reader to be left alone")
+	}
+
+	tracker.done()
+}
@@ -2,16 +2,18 @@ package migration
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/gorilla/websocket"
 	"github.com/lxc/lxd/shared"
 )
 
-func rsyncWebsocket(cmd *exec.Cmd, conn *websocket.Conn) error {
+func rsyncWebsocket(cmd *exec.Cmd, conn *websocket.Conn, progress *progressTracker) error {
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -27,7 +29,7 @@ func rsyncWebsocket(cmd *exec.Cmd, conn *websocket.Conn) error {
 		return err
 	}
 
-	shared.WebsocketMirror(conn, stdin, stdout)
+	shared.WebsocketMirror(conn, progress.writer(stdin), progress.reader(stdout))
 	return cmd.Wait()
 }
 
@@ -42,7 +44,26 @@ func AddSlash(path string) string {
 	return path
 }
 
-func rsyncSendSetup(path string) (*exec.Cmd, net.Conn, error) {
+/*
+ * rsyncFilters selects what's sent of the container's directory: its rootfs
+ * and the snapshots listed in the header, which brings their state along.
+ */
+func rsyncFilters(snapshots []*Snapshot) []string {
+	escape := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+	filters := []string{"--include=/rootfs"}
+	if len(snapshots) > 0 {
+		filters = append(filters, "--include=/snapshots")
+	}
+
+	for _, snap := range snapshots {
+		filters = append(filters, fmt.Sprintf("--include=/snapshots/%s", escape.Replace(snap.GetName())))
+	}
+
+	return append(filters, "--exclude=/snapshots/*", "--exclude=/*")
+}
+
+func rsyncSendSetup(path string, filters []string) (*exec.Cmd, net.Conn, error) {
 	/*
 	 * It's sort of unfortunate, but there's no library call to get a
 	 * temporary name, so we get the file and close it and use its name.
@@ -85,7 +106,9 @@ func rsyncSendSetup(path string) (*exec.Cmd, net.Conn, error) {
 	 * hardcoding that at the other end, so we can just ignore it.
 	 */
 	rsyncCmd := fmt.Sprintf("sh -c \"nc -U %s\"", f.Name())
-	cmd := exec.Command("rsync", "-arvPz", "--devices", "--partial", path, "localhost:/tmp/foo", "-e", rsyncCmd)
+	args := append([]string{"-arvPz", "--devices", "--partial"}, filters...)
+	args = append(args, path, "localhost:/tmp/foo", "-e", rsyncCmd)
+	cmd := exec.Command("rsync", args...)
 	if err := cmd.Start(); err != nil {
 		return nil, nil, err
 	}
@@ -100,9 +123,15 @@ func rsyncSendSetup(path string) (*exec.Cmd, net.Conn, error) {
 }
 
 // RsyncSend sets up the sending half of an rsync, to recursively send the
-// directory pointed to by path over the websocket.
-func RsyncSend(path string, conn *websocket.Conn) error {
-	cmd, dataSocket, err := rsyncSendSetup(path)
+// directory pointed to by path over the websocket. Filters are rsync
+// --include/--exclude options selecting what's sent.
+func RsyncSend(path string, conn *websocket.Conn, filters ...string) error {
+	return rsyncSend(path, conn, nil, filters...)
+}
+
+// rsyncSend is RsyncSend, counting what goes over the websocket.
+func rsyncSend(path string, conn *websocket.Conn, progress *progressTracker, filters ...string) error {
+	cmd, dataSocket, err := rsyncSendSetup(path, filters)
 	if dataSocket != nil {
 		defer dataSocket.Close()
 	}
@@ -110,7 +139,7 @@ func RsyncSend(path string, conn *websocket.Conn) error {
 		return err
 	}
 
-	shared.WebsocketMirror(conn, dataSocket, dataSocket)
+	shared.WebsocketMirror(conn, progress.writer(dataSocket), progress.reader(dataSocket))
 
 	return cmd.Wait()
 }
@@ -123,5 +152,127 @@ func rsyncRecvCmd(path string) *exec.Cmd {
 // half set up by RsyncSend), putting the contents in the directory specified
 // by path.
 func RsyncRecv(path string, conn *websocket.Conn) error {
-	return rsyncWebsocket(rsyncRecvCmd(path), conn)
+	return rsyncWebsocket(rsyncRecvCmd(path), conn, nil)
+}
+
+func closeWrite(w io.WriteCloser) error {
+	if cw, ok := w.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+
+	return w.Close()
+}
+
+/*
+ * mirrorRound is like shared.WebsocketMirror, except that it leaves the
+ * websocket open so that it can carry more transfers: instead of closing
+ * it, each end marks the end of its data with an empty message. It returns
+ * once both ends are done.
+ */
+func mirrorRound(conn *websocket.Conn, w io.WriteCloser, r io.Reader) error {
+	sent := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 128*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					sent <- err
+					return
+				}
+			}
+
+			if err != nil {
+				break
+			}
+		}
+
+		sent <- conn.WriteMessage(websocket.BinaryMessage, []byte{})
+	}()
+
+	var recvErr error
+	for {
+		mt, buf, err := conn.ReadMessage()
+		if err != nil {
+			recvErr = err
+			break
+		}
+
+		if mt != websocket.BinaryMessage {
+			recvErr = fmt.Errorf("only binary messages allowed")
+			break
+		}
+
+		if len(buf) == 0 {
+			break
+		}
+
+		/* Keep reading up to the end marker, even if w is gone */
+		if recvErr == nil {
+			_, recvErr = w.Write(buf)
+		}
+	}
+
+	closeWrite(w)
+
+	if err := <-sent; err != nil {
+		return err
+	}
+
+	return recvErr
+}
+
+// RsyncSendRound is RsyncSend, leaving the websocket open for more
+// transfers. The other end must use RsyncRecvRound.
+func RsyncSendRound(path string, conn *websocket.Conn, filters ...string) error {
+	return rsyncSendRound(path, conn, nil, filters...)
+}
+
+func rsyncSendRound(path string, conn *websocket.Conn, progress *progressTracker, filters ...string) error {
+	cmd, dataSocket, err := rsyncSendSetup(path, filters)
+	if dataSocket != nil {
+		defer dataSocket.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = mirrorRound(conn, progress.writer(dataSocket), progress.reader(dataSocket))
+	if err2 := cmd.Wait(); err == nil {
+		err = err2
+	}
+
+	return err
+}
+
+// RsyncRecvRound is RsyncRecv, for transfers sent with RsyncSendRound.
+func RsyncRecvRound(path string, conn *websocket.Conn) error {
+	return rsyncRecvRound(path, conn, nil)
+}
+
+func rsyncRecvRound(path string, conn *websocket.Conn, progress *progressTracker) error {
+	cmd := rsyncRecvCmd(path)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = mirrorRound(conn, progress.writer(stdin), progress.reader(stdout))
+	if err2 := cmd.Wait(); err == nil {
+		err = err2
+	}
+
+	return err
 }
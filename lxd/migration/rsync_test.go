@@ -1,11 +1,19 @@
 package migration
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/lxc/lxd/shared"
 )
 
 const helloWorld = "hello world\n"
@@ -34,7 +42,7 @@ func TestRsyncSendRecv(t *testing.T) {
 	f.Write([]byte(helloWorld))
 	f.Close()
 
-	send, sendConn, err := rsyncSendSetup(AddSlash(source))
+	send, sendConn, err := rsyncSendSetup(AddSlash(source), nil)
 	if err != nil {
 		t.Error(err)
 		return
@@ -102,3 +110,84 @@ func TestRsyncSendRecv(t *testing.T) {
 		return
 	}
 }
+
+func TestRsyncFilters(t *testing.T) {
+	snapshots := []*Snapshot{
+		&Snapshot{Name: proto.String("snap0")},
+		&Snapshot{Name: proto.String("a*b")},
+	}
+
+	expected := []string{
+		"--include=/rootfs",
+		"--include=/snapshots",
+		"--include=/snapshots/snap0",
+		`--include=/snapshots/a\*b`,
+		"--exclude=/snapshots/*",
+		"--exclude=/*",
+	}
+
+	filters := rsyncFilters(snapshots)
+	if strings.Join(filters, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v got %v", expected, filters)
+	}
+
+	filters = rsyncFilters(nil)
+	if strings.Join(filters, " ") != "--include=/rootfs --exclude=/snapshots/* --exclude=/*" {
+		t.Errorf("unexpected filters without snapshots: %v", filters)
+	}
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestMirrorRound(t *testing.T) {
+	rounds := []string{"first round", "second round"}
+	serverGot := make(chan []string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := shared.WebsocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		got := []string{}
+		for _, round := range rounds {
+			buf := &bufferCloser{}
+			if err := mirrorRound(conn, buf, strings.NewReader("reply to "+round)); err != nil {
+				t.Error(err)
+			}
+			got = append(got, buf.String())
+		}
+		serverGot <- got
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, round := range rounds {
+		buf := &bufferCloser{}
+		if err := mirrorRound(conn, buf, strings.NewReader(round)); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String() != "reply to "+round {
+			t.Errorf("expected %q got %q", "reply to "+round, buf.String())
+		}
+	}
+
+	got := <-serverGot
+	if strings.Join(got, ",") != strings.Join(rounds, ",") {
+		t.Errorf("expected %v got %v", rounds, got)
+	}
+}
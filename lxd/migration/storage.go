@@ -0,0 +1,312 @@
+package migration
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/lxc/lxd/shared"
+)
+
+/*
+ * sendFSType is the format the source proposes to send the container in
+ * path with: btrfs send when the container and all its snapshots are
+ * subvolumes, rsync otherwise. Snapshots which are plain directories would
+ * be sent along with the container's subvolume, whether they were to be
+ * sent or not.
+ */
+func sendFSType(path string, snapshots []*Snapshot) MigrationFSType {
+	fs, err := shared.GetFilesystem(path)
+	if err != nil {
+		return MigrationFSType_RSYNC
+	}
+
+	switch fs {
+	case "btrfs":
+		if _, err := exec.LookPath("btrfs"); err != nil || !shared.IsBtrfsSubvolume(path) {
+			return MigrationFSType_RSYNC
+		}
+
+		for _, snap := range snapshots {
+			if !shared.IsBtrfsSubvolume(filepath.Join(path, "snapshots", snap.GetName())) {
+				return MigrationFSType_RSYNC
+			}
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(path, "snapshots"))
+		if err != nil && !os.IsNotExist(err) {
+			return MigrationFSType_RSYNC
+		}
+
+		for _, f := range files {
+			if !shared.IsBtrfsSubvolume(filepath.Join(path, "snapshots", f.Name())) {
+				return MigrationFSType_RSYNC
+			}
+		}
+
+		return MigrationFSType_BTRFS
+	}
+
+	return MigrationFSType_RSYNC
+}
+
+/*
+ * recvFSType is the format the sink answers the source's proposal with:
+ * the same one if it can receive it into the containers' directory lxcDir,
+ * or rsync.
+ */
+func recvFSType(proposed MigrationFSType, lxcDir string) MigrationFSType {
+	if proposed == MigrationFSType_BTRFS {
+		fs, err := shared.GetFilesystem(lxcDir)
+		if _, err2 := exec.LookPath("btrfs"); err == nil && err2 == nil && fs == "btrfs" {
+			return proposed
+		}
+	}
+
+	return MigrationFSType_RSYNC
+}
+
+/*
+ * fsSend sends the container's directory, with the snapshots listed in the
+ * header, in the negotiated format.
+ */
+func fsSend(fsType MigrationFSType, path string, snapshots []*Snapshot, conn *websocket.Conn, progress *progressTracker) error {
+	switch fsType {
+	case MigrationFSType_RSYNC:
+		return rsyncSend(AddSlash(path), conn, progress, rsyncFilters(snapshots)...)
+	case MigrationFSType_BTRFS:
+		return btrfsSend(path, snapshots, conn, progress)
+	}
+
+	return fmt.Errorf("Unknown filesystem transfer type %s", fsType)
+}
+
+// fsRecv receives what fsSend sent into the container's directory path.
+func fsRecv(fsType MigrationFSType, path string, snapshots []*Snapshot, conn *websocket.Conn, progress *progressTracker) error {
+	switch fsType {
+	case MigrationFSType_RSYNC:
+		return rsyncWebsocket(rsyncRecvCmd(AddSlash(path)), conn, progress)
+	case MigrationFSType_BTRFS:
+		return btrfsRecv(path, snapshots, conn, progress)
+	}
+
+	return fmt.Errorf("Unknown filesystem transfer type %s", fsType)
+}
+
+type discardCloser struct{}
+
+func (discardCloser) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardCloser) Close() error {
+	return nil
+}
+
+/*
+ * sendStream sends what r reads as one transfer, leaving the websocket
+ * open for more. The other end must use recvStream.
+ */
+func sendStream(conn *websocket.Conn, r io.Reader) error {
+	return mirrorRound(conn, discardCloser{}, r)
+}
+
+// recvStream writes a transfer sent with sendStream to w.
+func recvStream(conn *websocket.Conn, w io.WriteCloser) error {
+	return mirrorRound(conn, w, strings.NewReader(""))
+}
+
+func cmdError(cmd *exec.Cmd, stderr *bytes.Buffer, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%s failed: %s (%s)", strings.Join(cmd.Args, " "), err, strings.TrimSpace(stderr.String()))
+}
+
+// sendCmd sends the output of cmd over the websocket with sendStream.
+func sendCmd(conn *websocket.Conn, cmd *exec.Cmd, progress *progressTracker) error {
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = sendStream(conn, progress.reader(stdout))
+	if err2 := cmd.Wait(); err2 != nil {
+		err = err2
+	}
+
+	return cmdError(cmd, stderr, err)
+}
+
+// recvCmd feeds a transfer sent with sendCmd to cmd.
+func recvCmd(conn *websocket.Conn, cmd *exec.Cmd, progress *progressTracker) error {
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = recvStream(conn, progress.writer(stdin))
+	if err2 := cmd.Wait(); err2 != nil {
+		err = err2
+	}
+
+	return cmdError(cmd, stderr, err)
+}
+
+func btrfsDelete(subvol string) {
+	if err := exec.Command("btrfs", "subvolume", "delete", subvol).Run(); err != nil {
+		shared.Debugf("error deleting subvolume %s: %s", subvol, err)
+	}
+}
+
+/*
+ * btrfsSend sends the snapshots, oldest first, and then the container,
+ * each as a stream of its own. btrfs only sends read-only subvolumes, so
+ * we send read-only snapshots of them, and each one after the first only
+ * as its difference to the one before.
+ */
+func btrfsSend(path string, snapshots []*Snapshot, conn *websocket.Conn, progress *progressTracker) error {
+	tmp, err := ioutil.TempDir(filepath.Dir(path), ".migration_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	subvols := []string{}
+	for _, snap := range snapshots {
+		subvols = append(subvols, filepath.Join(path, "snapshots", snap.GetName()))
+	}
+	subvols = append(subvols, path)
+
+	parent := ""
+	for i, subvol := range subvols {
+		ro := filepath.Join(tmp, strconv.Itoa(i))
+		if err := exec.Command("btrfs", "subvolume", "snapshot", "-r", subvol, ro).Run(); err != nil {
+			return fmt.Errorf("Failed to snapshot %s: %s", subvol, err)
+		}
+		defer btrfsDelete(ro)
+
+		args := []string{"send"}
+		if parent != "" {
+			args = append(args, "-p", parent)
+		}
+		args = append(args, ro)
+
+		if err := sendCmd(conn, exec.Command("btrfs", args...), progress); err != nil {
+			return err
+		}
+
+		parent = ro
+	}
+
+	return nil
+}
+
+/*
+ * btrfsRecv receives the streams btrfsSend sent, and puts writable
+ * snapshots of the received subvolumes in place of the container and its
+ * snapshots. The received ones are kept until the end, since the later
+ * streams are sent relative to them.
+ */
+func btrfsRecv(path string, snapshots []*Snapshot, conn *websocket.Conn, progress *progressTracker) error {
+	tmp, err := ioutil.TempDir(filepath.Dir(path), ".migration_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	received := []string{}
+	for i := 0; i <= len(snapshots); i++ {
+		dir := filepath.Join(tmp, strconv.Itoa(i))
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+
+		if err := recvCmd(conn, exec.Command("btrfs", "receive", dir), progress); err != nil {
+			return err
+		}
+
+		/* btrfs receive names the subvolume like the sent one */
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		if len(files) != 1 {
+			return fmt.Errorf("Expected one received subvolume in %s, found %d", dir, len(files))
+		}
+
+		subvol := filepath.Join(dir, files[0].Name())
+		received = append(received, subvol)
+		defer btrfsDelete(subvol)
+	}
+
+	/* The (empty) directory was only created for rsync */
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := exec.Command("btrfs", "subvolume", "snapshot", received[len(snapshots)], path).Run(); err != nil {
+		return fmt.Errorf("Failed to create the container's subvolume: %s", err)
+	}
+
+	/*
+	 * Only the rootfs is wanted of the container's subvolume (rsync
+	 * doesn't send the rest either), and the snapshots, which are
+	 * subvolumes, weren't sent along with it: they're only empty
+	 * directories.
+	 */
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.Name() != "rootfs" {
+			if err := os.RemoveAll(filepath.Join(path, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	snapshotsDir := filepath.Join(path, "snapshots")
+
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(snapshotsDir, 0700); err != nil {
+		return err
+	}
+
+	for i, snap := range snapshots {
+		snapDir := filepath.Join(snapshotsDir, snap.GetName())
+		if err := exec.Command("btrfs", "subvolume", "snapshot", received[i], snapDir).Run(); err != nil {
+			return fmt.Errorf("Failed to create the subvolume of snapshot %s: %s", snap.GetName(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package migration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/lxc/lxd/shared"
+)
+
+func TestSendRecvStream(t *testing.T) {
+	streams := []string{"first stream", "", "third stream"}
+	done := make(chan bool, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { done <- true }()
+
+		conn, err := shared.WebsocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		for _, stream := range streams {
+			if err := sendStream(conn, strings.NewReader(stream)); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, stream := range streams {
+		buf := &bufferCloser{}
+		if err := recvStream(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String() != stream {
+			t.Errorf("expected %q got %q", stream, buf.String())
+		}
+	}
+
+	<-done
+}
+
+func TestFSTypeFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxd_migration_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	/* A plain directory is never a subvolume */
+	if err := os.Mkdir(dir+"/c1", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := shared.GetFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fs != "btrfs" {
+		if fsType := sendFSType(dir+"/c1", nil); fsType != MigrationFSType_RSYNC {
+			t.Errorf("expected RSYNC to be proposed on %s, got %s", fs, fsType)
+		}
+	}
+
+	if fsType := recvFSType(MigrationFSType_RSYNC, dir); fsType != MigrationFSType_RSYNC {
+		t.Errorf("expected RSYNC to stay RSYNC, got %s", fsType)
+	}
+
+	if fs != "btrfs" {
+		if fsType := recvFSType(MigrationFSType_BTRFS, dir); fsType != MigrationFSType_RSYNC {
+			t.Errorf("expected BTRFS to fall back to RSYNC on %s, got %s", fs, fsType)
+		}
+	}
+}
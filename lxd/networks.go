@@ -70,10 +70,14 @@ func isOnBridge(c *lxc.Container, bridge string) bool {
 	kids := children(bridge)
 	for i := 0; i < len(c.ConfigItem("lxc.network")); i++ {
 		interfaceType := c.RunningConfigItem(fmt.Sprintf("lxc.network.%d.type", i))
-		if interfaceType[0] == "veth" {
-			cif := c.RunningConfigItem(fmt.Sprintf("lxc.network.%d.veth.pair", i))[0]
+		if len(interfaceType) > 0 && interfaceType[0] == "veth" {
+			pair := c.RunningConfigItem(fmt.Sprintf("lxc.network.%d.veth.pair", i))
+			if len(pair) == 0 {
+				continue
+			}
+
 			for _, kif := range kids {
-				if cif == kif {
+				if pair[0] == kif {
 					return true
 				}
 
@@ -83,6 +87,36 @@ func isOnBridge(c *lxc.Container, bridge string) bool {
 	return false
 }
 
+/*
+ * isUsingInterface tells whether the container has a macvlan nic on top of
+ * iface, or is the other end of iface when it's the host side of a p2p
+ * nic. Physical nics are moved into the container, so they don't show up on
+ * the host anymore while it runs.
+ */
+func isUsingInterface(c *lxc.Container, iface string) bool {
+	for i := 0; i < len(c.ConfigItem("lxc.network")); i++ {
+		interfaceType := c.RunningConfigItem(fmt.Sprintf("lxc.network.%d.type", i))
+		if len(interfaceType) == 0 {
+			continue
+		}
+
+		var item []string
+		switch interfaceType[0] {
+		case "macvlan":
+			item = c.RunningConfigItem(fmt.Sprintf("lxc.network.%d.link", i))
+		case "veth":
+			item = c.RunningConfigItem(fmt.Sprintf("lxc.network.%d.veth.pair", i))
+		default:
+			continue
+		}
+
+		if len(item) > 0 && item[0] == iface {
+			return true
+		}
+	}
+	return false
+}
+
 func networkGet(d *Daemon, r *http.Request) Response {
 	name := mux.Vars(r)["name"]
 
@@ -110,7 +144,22 @@ func networkGet(d *Daemon, r *http.Request) Response {
 			}
 		}
 	} else {
-		n.Type = "unknown"
+		if shared.PathExists(path.Join(SYS_CLASS_NET, n.Name, "device")) {
+			n.Type = "physical"
+		} else {
+			n.Type = "unknown"
+		}
+
+		for _, ct := range lxc.ActiveContainerNames(d.lxcpath) {
+			c, err := newLxdContainer(ct, d)
+			if err != nil {
+				return InternalError(err)
+			}
+
+			if isUsingInterface(c.c, n.Name) {
+				n.Members = append(n.Members, ct)
+			}
+		}
 	}
 
 	return SyncResponse(true, &n)
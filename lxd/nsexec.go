@@ -0,0 +1,298 @@
+package main
+
+/*
+#define _GNU_SOURCE
+#include <errno.h>
+#include <fcntl.h>
+#include <libgen.h>
+#include <limits.h>
+#include <sched.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/mount.h>
+#include <sys/stat.h>
+#include <sys/types.h>
+#include <unistd.h>
+
+// A multithreaded process can't setns() into another mount namespace, and
+// the go runtime starts its threads before main() is called, so the
+// commands which need to do so are implemented here and run from a
+// constructor, before the runtime is initialized.
+
+static int mkdir_p(const char *dir, mode_t mode)
+{
+	char *tmp = strdup(dir);
+	char *p;
+
+	if (!tmp)
+		return -1;
+
+	for (p = tmp + 1; *p; p++) {
+		if (*p != '/')
+			continue;
+
+		*p = '\0';
+		if (mkdir(tmp, mode) < 0 && errno != EEXIST) {
+			free(tmp);
+			return -1;
+		}
+		*p = '/';
+	}
+
+	free(tmp);
+	if (mkdir(dir, mode) < 0 && errno != EEXIST)
+		return -1;
+
+	return 0;
+}
+
+static int create_target(const char *src, const char *dest)
+{
+	struct stat sb;
+	char *dir;
+	int fd, ret;
+
+	dir = strdup(dest);
+	if (!dir)
+		return -1;
+	ret = mkdir_p(dirname(dir), 0755);
+	free(dir);
+	if (ret < 0)
+		return -1;
+
+	if (stat(src, &sb) < 0)
+		return -1;
+
+	if (S_ISDIR(sb.st_mode))
+		return mkdir_p(dest, 0755);
+
+	fd = open(dest, O_CREAT | O_WRONLY, 0600);
+	if (fd < 0)
+		return -1;
+	close(fd);
+
+	return 0;
+}
+
+static void enter_mntns(char *pid)
+{
+	char path[PATH_MAX];
+	int fd;
+
+	snprintf(path, sizeof(path), "/proc/%s/ns/mnt", pid);
+	fd = open(path, O_RDONLY);
+	if (fd < 0) {
+		fprintf(stderr, "Failed to open %s: %s\n", path, strerror(errno));
+		_exit(1);
+	}
+
+	if (setns(fd, CLONE_NEWNS) < 0) {
+		fprintf(stderr, "Failed to enter the mount namespace: %s\n", strerror(errno));
+		_exit(1);
+	}
+	close(fd);
+}
+
+// forkmount <pid> <src> <dest> <flags>: moves the mount at src, inside the
+// mount namespace of pid, to dest, creating dest if needed, then applies
+// the propagation flags (if any) to it.
+static void forkmount(char *pid, char *src, char *dest, char *flags)
+{
+	unsigned long propagation = strtoul(flags, NULL, 10);
+
+	enter_mntns(pid);
+
+	if (create_target(src, dest) < 0) {
+		fprintf(stderr, "Failed to create %s: %s\n", dest, strerror(errno));
+		_exit(1);
+	}
+
+	if (mount(src, dest, "none", MS_MOVE, NULL) < 0) {
+		fprintf(stderr, "Failed to move %s to %s: %s\n", src, dest, strerror(errno));
+		_exit(1);
+	}
+
+	if (propagation && mount(NULL, dest, NULL, propagation, NULL) < 0) {
+		fprintf(stderr, "Failed to set the propagation of %s: %s\n", dest, strerror(errno));
+		_exit(1);
+	}
+
+	_exit(0);
+}
+
+// forkumount <pid> <dest>: unmounts dest inside the mount namespace of pid
+// and removes what was created to mount it on.
+static void forkumount(char *pid, char *dest)
+{
+	struct stat sb;
+
+	enter_mntns(pid);
+
+	if (umount2(dest, MNT_DETACH) < 0) {
+		fprintf(stderr, "Failed to unmount %s: %s\n", dest, strerror(errno));
+		_exit(1);
+	}
+
+	if (stat(dest, &sb) == 0) {
+		if (S_ISDIR(sb.st_mode))
+			rmdir(dest);
+		else
+			unlink(dest);
+	}
+
+	_exit(0);
+}
+
+__attribute__((constructor)) void nsexec(void)
+{
+	char cmdline[PATH_MAX * 4];
+	char *args[6];
+	ssize_t size;
+	int fd, i = 0;
+	char *cur;
+
+	fd = open("/proc/self/cmdline", O_RDONLY);
+	if (fd < 0)
+		return;
+
+	size = read(fd, cmdline, sizeof(cmdline) - 1);
+	close(fd);
+	if (size <= 0)
+		return;
+	cmdline[size] = '\0';
+
+	for (cur = cmdline; cur < cmdline + size && i < 6; cur += strlen(cur) + 1)
+		args[i++] = cur;
+
+	if (i < 2)
+		return;
+
+	if (strcmp(args[1], "forkmount") == 0) {
+		if (i != 6) {
+			fprintf(stderr, "Usage: lxd forkmount <pid> <source> <destination> <flags>\n");
+			_exit(1);
+		}
+
+		forkmount(args[2], args[3], args[4], args[5]);
+	} else if (strcmp(args[1], "forkumount") == 0) {
+		if (i != 4) {
+			fprintf(stderr, "Usage: lxd forkumount <pid> <destination>\n");
+			_exit(1);
+		}
+
+		forkumount(args[2], args[3]);
+	}
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/lxc/lxd/shared"
+)
+
+/*
+ * Every container gets its directory under shmounts bind mounted at
+ * dev/.lxd-mounts. As shmounts is a shared mount, whatever is mounted there
+ * on the host shows up in the running container too, and can then be moved
+ * to its final place from within the container's mount namespace.
+ */
+func setupSharedMounts() error {
+	p := shared.VarPath("shmounts")
+	if err := os.MkdirAll(p, 0711); err != nil {
+		return err
+	}
+
+	if isMountPoint(p) {
+		return nil
+	}
+
+	if err := syscall.Mount("tmpfs", p, "tmpfs", 0, "size=100k,mode=0711"); err != nil {
+		return fmt.Errorf("Failed to mount %s: %s", p, err)
+	}
+
+	return syscall.Mount("none", p, "", syscall.MS_SHARED, "")
+}
+
+func isMountPoint(p string) bool {
+	stat := syscall.Stat_t{}
+	if err := syscall.Stat(p, &stat); err != nil {
+		return false
+	}
+
+	parent := syscall.Stat_t{}
+	if err := syscall.Stat(filepath.Dir(p), &parent); err != nil {
+		return false
+	}
+
+	return stat.Dev != parent.Dev
+}
+
+/*
+ * mountInto bind mounts source, a path on the host, at target inside the
+ * running container. flags may contain MS_REC for a recursive bind mount,
+ * MS_RDONLY for a read-only one and propagation flags.
+ */
+func (c *lxdContainer) mountInto(source string, target string, flags uintptr) error {
+	dir := shared.VarPath("shmounts", c.name)
+	if err := os.MkdirAll(dir, 0711); err != nil {
+		return err
+	}
+
+	name := filepath.Base(source)
+	p := filepath.Join(dir, name)
+	if shared.IsDir(source) {
+		if err := os.MkdirAll(p, 0700); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	defer os.Remove(p)
+
+	if err := syscall.Mount(source, p, "none", syscall.MS_BIND|(flags&syscall.MS_REC), ""); err != nil {
+		return fmt.Errorf("Failed to mount %s: %s", source, err)
+	}
+	defer syscall.Unmount(p, syscall.MNT_DETACH)
+
+	if flags&syscall.MS_RDONLY != 0 {
+		if err := syscall.Mount("", p, "none", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("Failed to make %s read-only: %s", source, err)
+		}
+	}
+
+	propagation := flags & (syscall.MS_PRIVATE | syscall.MS_SHARED | syscall.MS_SLAVE | syscall.MS_UNBINDABLE)
+	if propagation != 0 {
+		propagation |= flags & syscall.MS_REC
+	}
+
+	pid := fmt.Sprintf("%d", c.c.InitPid())
+	output, err := exec.Command("/proc/self/exe", "forkmount", pid, filepath.Join("/dev/.lxd-mounts", name), target, fmt.Sprintf("%d", propagation)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to mount %s at %s: %s", source, target, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// unmountFrom unmounts target inside the running container.
+func (c *lxdContainer) unmountFrom(target string) error {
+	pid := fmt.Sprintf("%d", c.c.InitPid())
+	output, err := exec.Command("/proc/self/exe", "forkumount", pid, target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to unmount %s: %s", target, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -70,7 +70,13 @@ func StartOperation(id string) error {
 			shared.Debugf("operation %s finished: %s", op.Run, result)
 
 			lock.Lock()
-			op.SetResult(result)
+			if op.StatusCode == shared.Cancelling || op.StatusCode == shared.Cancelled {
+				/* It stopped because it was cancelled, not because it failed */
+				op.SetStatus(shared.Cancelled)
+				op.Chan <- true
+			} else {
+				op.SetResult(result)
+			}
 			op.Run = nil
 			op.Cancel = nil
 			op.Websocket = nil
@@ -84,6 +90,32 @@ func StartOperation(id string) error {
 	return nil
 }
 
+/*
+ * OperationUpdateMetadata replaces the metadata of a running operation, e.g.
+ * to report its progress.
+ */
+func OperationUpdateMetadata(id string, metadata interface{}) error {
+	md, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	op, ok := operations[id]
+	if !ok {
+		return fmt.Errorf("operation %s doesn't exist", id)
+	}
+
+	if op.StatusCode.IsFinal() {
+		return nil
+	}
+
+	op.Metadata = md
+	op.UpdatedAt = time.Now()
+	return nil
+}
+
 func operationsGet(d *Daemon, r *http.Request) Response {
 	ops := shared.Jmap{"pending": make([]string, 0, 0), "running": make([]string, 0, 0)}
 
@@ -145,7 +177,12 @@ func operationDelete(d *Daemon, r *http.Request) Response {
 		err := cancel()
 
 		lock.Lock()
-		op.SetStatusByErr(err)
+		if err != nil {
+			op.SetStatusByErr(err)
+		} else if op.Run == nil && !op.StatusCode.IsFinal() {
+			/* Otherwise, it's cancelled once its run function returns */
+			op.SetStatus(shared.Cancelled)
+		}
 		lock.Unlock()
 
 		if err != nil {
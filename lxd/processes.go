@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lxc/lxd/shared"
+)
+
+/* /proc/<pid>/stat counts CPU time in USER_HZ, which is always 100 */
+const userHz = 100
+
+/*
+ * procStatus reads the fields of /proc/<pid>/status the process listing
+ * needs: the pids of the process in each of its pid namespaces (NSpid,
+ * outermost first), its parent's pid in the host's namespace and its real
+ * uid.
+ */
+func procStatus(pid int) (nspids []int, ppid int, uid int, err error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "NSpid:":
+			for _, field := range fields[1:] {
+				n, err := strconv.Atoi(field)
+				if err != nil {
+					return nil, 0, 0, err
+				}
+				nspids = append(nspids, n)
+			}
+		case "PPid:":
+			ppid, err = strconv.Atoi(fields[1])
+		case "Uid:":
+			uid, err = strconv.Atoi(fields[1])
+		}
+
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	return nspids, ppid, uid, scanner.Err()
+}
+
+// procUsage returns the CPU time and resident memory of the process.
+func procUsage(pid int) (int64, int64, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	/* The command name can contain spaces, the fields are after it */
+	s := string(stat)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("Bad /proc/%d/stat", pid)
+	}
+
+	/* utime and stime, the 14th and 15th fields */
+	ticks := int64(0)
+	for _, field := range fields[11:13] {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		ticks += n
+	}
+
+	statm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields = strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("Bad /proc/%d/statm", pid)
+	}
+
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return ticks * int64(time.Second) / userHz, pages * int64(os.Getpagesize()), nil
+}
+
+/* The most of the container's /etc/passwd which is read */
+const passwdMaxSize = 1024 * 1024
+
+/*
+ * readContainerPasswd reads the /etc/passwd of the container whose init is
+ * pid. It's read as root on the host, so no symlink in the container is
+ * followed (those would be resolved against the host's root), and only a
+ * regular file is read (a FIFO would block us).
+ */
+func readContainerPasswd(pid int) (string, error) {
+	root, err := syscall.Open(fmt.Sprintf("/proc/%d/root", pid), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(root)
+
+	etc, err := syscall.Openat(root, "etc", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(etc)
+
+	fd, err := syscall.Openat(etc, "passwd", syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+
+	f := os.NewFile(uintptr(fd), "/etc/passwd")
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("/etc/passwd isn't a regular file")
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(f, passwdMaxSize))
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// parsePasswd maps the uids of a passwd file to user names.
+func parsePasswd(content string) map[int]string {
+	users := map[int]string{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+
+		if _, ok := users[uid]; !ok {
+			users[uid] = fields[0]
+		}
+	}
+
+	return users
+}
+
+/*
+ * processes lists the processes of the running container, found through
+ * its cgroup, so those of nested containers are included.
+ */
+func (c *lxdContainer) processes() ([]shared.ContainerProcess, error) {
+	initPid := c.c.InitPid()
+	initPids, _, _, err := procStatus(initPid)
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+	 * Without NSpid (before Linux 4.1), the pids in the container
+	 * can't be known.
+	 */
+	level := len(initPids) - 1
+
+	root, err := cgroupPath(initPid, "memory")
+	if err != nil {
+		return nil, err
+	}
+
+	idmap, err := c.currentIdmap()
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[int]string{}
+	passwd, err := readContainerPasswd(initPid)
+	if err == nil {
+		users = parsePasswd(passwd)
+	} else {
+		shared.Debugf("Error reading the users of %s: %s\n", c.name, err)
+	}
+
+	hostToNs := map[int]int{}
+	processes := []shared.ContainerProcess{}
+	for _, pid := range cgroupProcs(root) {
+		nspids, ppid, uid, err := procStatus(pid)
+		if err != nil {
+			/* It's gone already */
+			continue
+		}
+
+		p := shared.ContainerProcess{HostPid: pid, ParentPid: ppid, Uid: idmap.nsUid(uid)}
+		if level >= 0 && len(nspids) > level {
+			p.Pid = nspids[level]
+		}
+		hostToNs[pid] = p.Pid
+
+		p.User = users[p.Uid]
+
+		cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err == nil {
+			p.Command = strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		}
+
+		p.CPUTime, p.Memory, _ = procUsage(pid)
+
+		processes = append(processes, p)
+	}
+
+	/* Parents outside the container (for init) show up as 0 */
+	for i, p := range processes {
+		processes[i].ParentPid = hostToNs[p.ParentPid]
+	}
+
+	return processes, nil
+}
+
+func containerProcessesGet(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+	c, err := newLxdContainer(name, d)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if !c.c.Running() {
+		return BadRequest(fmt.Errorf("Container is not running"))
+	}
+
+	processes, err := c.processes()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	return SyncResponse(true, processes)
+}
+
+type containerProcessesPostReq struct {
+	Pid    int `json:"pid"`
+	Signal int `json:"signal"`
+}
+
+func containerProcessesPost(d *Daemon, r *http.Request) Response {
+	name := mux.Vars(r)["name"]
+	c, err := newLxdContainer(name, d)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	req := containerProcessesPostReq{Signal: int(syscall.SIGTERM)}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return BadRequest(err)
+	}
+
+	if req.Signal <= 0 || req.Signal > 64 {
+		return BadRequest(fmt.Errorf("Invalid signal: %d", req.Signal))
+	}
+
+	if !c.c.Running() {
+		return BadRequest(fmt.Errorf("Container is not running"))
+	}
+
+	processes, err := c.processes()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	/* Only ever signal processes which are in the container */
+	for _, p := range processes {
+		if p.Pid == 0 || p.Pid != req.Pid {
+			continue
+		}
+
+		if err := syscall.Kill(p.HostPid, syscall.Signal(req.Signal)); err != nil {
+			return SmartError(err)
+		}
+
+		return EmptySyncResponse
+	}
+
+	return NotFound
+}
+
+var containerProcessesCmd = Command{name: "containers/{name}/processes", get: containerProcessesGet, post: containerProcessesPost}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParsePasswd(t *testing.T) {
+	users := parsePasswd("root:x:0:0:root:/root:/bin/bash\nubuntu:x:1000:1000::/home/ubuntu:/bin/bash\nbad line\ntoor:x:0:0::/root:/bin/sh\n")
+
+	if users[0] != "root" || users[1000] != "ubuntu" {
+		t.Errorf("Bad users: %v", users)
+	}
+
+	if len(users) != 2 {
+		t.Errorf("Expected 2 users, got %d", len(users))
+	}
+}
+
+func TestProcStatus(t *testing.T) {
+	nspids, ppid, uid, err := procStatus(os.Getpid())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if ppid != os.Getppid() {
+		t.Errorf("Expected parent %d, got %d", os.Getppid(), ppid)
+	}
+
+	if uid != os.Getuid() {
+		t.Errorf("Expected uid %d, got %d", os.Getuid(), uid)
+	}
+
+	if len(nspids) > 0 && nspids[0] != os.Getpid() {
+		t.Errorf("Expected pid %d, got %d", os.Getpid(), nspids[0])
+	}
+}
+
+func TestProcUsage(t *testing.T) {
+	_, memory, err := procUsage(os.Getpid())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if memory <= 0 {
+		t.Errorf("Bad resident memory: %d", memory)
+	}
+}
+
+func TestReadContainerPasswd(t *testing.T) {
+	fi, err := os.Lstat("/etc/passwd")
+	if err != nil || !fi.Mode().IsRegular() {
+		t.Skip("no regular /etc/passwd")
+	}
+
+	passwd, err := readContainerPasswd(os.Getpid())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, ok := parsePasswd(passwd)[0]; !ok {
+		t.Errorf("No root user in: %s", passwd)
+	}
+}
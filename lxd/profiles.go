@@ -65,6 +65,14 @@ func profilesPost(d *Daemon, r *http.Request) Response {
 		return BadRequest(fmt.Errorf("No name provided"))
 	}
 
+	if err := containerValidConfig(req.Config, true); err != nil {
+		return BadRequest(err)
+	}
+
+	if err := containerValidDevices(req.Devices); err != nil {
+		return BadRequest(err)
+	}
+
 	name := req.Name
 
 	tx, err := shared.DbBegin(d.db)
@@ -156,15 +164,101 @@ func profilePut(d *Daemon, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
-	tx, err := shared.DbBegin(d.db)
+	if err := containerValidConfig(req.Config, true); err != nil {
+		return BadRequest(err)
+	}
+
+	if err := containerValidDevices(req.Devices); err != nil {
+		return BadRequest(err)
+	}
+
+	/* Remember the devices of the running containers to update them */
+	containers, err := dbGetProfileContainers(d, name)
 	if err != nil {
 		return InternalError(err)
 	}
 
+	oldDevices := map[string]shared.Devices{}
+	for _, cname := range containers {
+		oldDevices[cname] = containerRunningDevices(d, cname)
+	}
+
+	/*
+	 * Check the configuration the containers would run with, and that the
+	 * rootfs of a running one isn't to be shifted to another map.
+	 */
+	for _, cname := range containers {
+		c, err := newLxdContainer(cname, d)
+		if err != nil {
+			return SmartError(err)
+		}
+
+		own, err := dbGetConfig(d, c)
+		if err != nil {
+			return InternalError(err)
+		}
+
+		config, err := containerExpandConfig(d, c.profiles, map[string]map[string]string{name: req.Config}, own)
+		if err != nil {
+			return SmartError(err)
+		}
+
+		if err := containerValidExpandedConfig(config); err != nil {
+			return BadRequest(fmt.Errorf("Container %s: %s", cname, err))
+		}
+
+		if oldDevices[cname] != nil && idmapConfigChanged(c.expandedConfig(), config) {
+			return BadRequest(fmt.Errorf("security.privileged and security.idmap.* can't be changed while container %s is running", cname))
+		}
+	}
+
+	/* What to put back if the new profile can't be applied */
+	oldConfig, err := dbGetProfileConfig(d, name)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	oldProfileDevices, err := dbGetDevices(d, name, true)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if err := dbUpdateProfile(d, name, req.Config, req.Devices); err != nil {
+		return SmartError(err)
+	}
+
+	/* Apply the new profile to the running containers using it */
+	liveErr := profileApply(d, name, containers, oldDevices)
+	if liveErr == nil {
+		return EmptySyncResponse
+	}
+
+	/* Don't leave a profile behind which isn't applied */
+	running := map[string]shared.Devices{}
+	for _, cname := range containers {
+		running[cname] = containerRunningDevices(d, cname)
+	}
+
+	if err := dbUpdateProfile(d, name, oldConfig, oldProfileDevices); err != nil {
+		shared.Debugf("Error restoring profile %s: %s\n", name, err)
+	} else if err := profileApply(d, name, containers, running); err != nil {
+		shared.Debugf("Error restoring profile %s: %s\n", name, err)
+	}
+
+	return InternalError(liveErr)
+}
+
+// dbUpdateProfile replaces the configuration and devices of a profile.
+func dbUpdateProfile(d *Daemon, name string, config map[string]string, devices shared.Devices) error {
+	tx, err := shared.DbBegin(d.db)
+	if err != nil {
+		return err
+	}
+
 	rows, err := tx.Query("SELECT id FROM profiles WHERE name=?", name)
 	if err != nil {
 		tx.Rollback()
-		return SmartError(err)
+		return err
 	}
 	var id int
 	for rows.Next() {
@@ -172,8 +266,9 @@ func profilePut(d *Daemon, r *http.Request) Response {
 		err = rows.Scan(&i)
 		if err != nil {
 			shared.Debugf("DBERR: profilePut: scan returned error %q\n", err)
+			rows.Close()
 			tx.Rollback()
-			return InternalError(err)
+			return err
 		}
 		id = i
 	}
@@ -182,33 +277,51 @@ func profilePut(d *Daemon, r *http.Request) Response {
 	if err != nil {
 		shared.Debugf("DBERR: profilePut: Err returned an error %q\n", err)
 		tx.Rollback()
-		return InternalError(err)
+		return err
 	}
 
 	err = dbClearProfileConfig(tx, id)
 	if err != nil {
 		tx.Rollback()
-		return InternalError(err)
+		return err
 	}
 
-	err = addProfileConfig(tx, id, req.Config)
+	err = addProfileConfig(tx, id, config)
 	if err != nil {
 		tx.Rollback()
-		return SmartError(err)
+		return err
 	}
 
-	err = shared.AddDevices(tx, "profile", id, req.Devices)
+	err = shared.AddDevices(tx, "profile", id, devices)
 	if err != nil {
 		tx.Rollback()
-		return SmartError(err)
+		return err
 	}
 
-	err = shared.TxCommit(tx)
-	if err != nil {
-		return InternalError(err)
+	return shared.TxCommit(tx)
+}
+
+/*
+ * profileApply applies a profile which was just written to the containers
+ * using it, diffing the devices of the running ones against oldDevices. It
+ * goes through all of them and returns the first error.
+ */
+func profileApply(d *Daemon, name string, containers []string, oldDevices map[string]shared.Devices) error {
+	var liveErr error
+	for _, cname := range containers {
+		_, err := containerAllocateIdmap(d, cname)
+		if err == nil {
+			err = containerApplyLive(d, cname, oldDevices[cname])
+		}
+		if err != nil {
+			shared.Debugf("Error applying profile %s to container %s: %s\n", name, cname, err)
+			if liveErr == nil {
+				liveErr = fmt.Errorf("Failed updating container %s: %s", cname, err)
+			}
+		}
 	}
 
-	return EmptySyncResponse
+	return liveErr
 }
 
 func profileDelete(d *Daemon, r *http.Request) Response {
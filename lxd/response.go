@@ -28,6 +28,7 @@ type Response interface {
 type syncResponse struct {
 	success  bool
 	metadata interface{}
+	headers  map[string]string
 }
 
 /*
@@ -37,19 +38,32 @@ type syncResponse struct {
 type fileResponse struct {
 	req      *http.Request
 	path     string
+	file     *os.File
 	filename string
 	headers  map[string]string
 }
 
 func FileResponse(r *http.Request, path string, filename string, headers map[string]string) Response {
-	return &fileResponse{r, path, filename, headers}
+	return &fileResponse{r, path, nil, filename, headers}
+}
+
+/*
+ * OpenFileResponse serves a file which is already open, for when its path
+ * can't be trusted to still lead to it. The file is closed once rendered.
+ */
+func OpenFileResponse(r *http.Request, f *os.File, filename string, headers map[string]string) Response {
+	return &fileResponse{r, "", f, filename, headers}
 }
 
 func (r *fileResponse) Render(w http.ResponseWriter) error {
 
-	f, err := os.Open(r.path)
-	if err != nil {
-		return err
+	f := r.file
+	if f == nil {
+		var err error
+		f, err = os.Open(r.path)
+		if err != nil {
+			return err
+		}
 	}
 	defer f.Close()
 
@@ -68,6 +82,21 @@ func (r *fileResponse) Render(w http.ResponseWriter) error {
 	return nil
 }
 
+type textResponse struct {
+	contentType string
+	body        string
+}
+
+func TextResponse(contentType string, body string) Response {
+	return &textResponse{contentType, body}
+}
+
+func (r *textResponse) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", r.contentType)
+	_, err := io.WriteString(w, r.body)
+	return err
+}
+
 func WriteJson(w http.ResponseWriter, body interface{}) error {
 	var output io.Writer
 	var captured *bytes.Buffer
@@ -93,6 +122,10 @@ func (r *syncResponse) Render(w http.ResponseWriter) error {
 		status = shared.Failure
 	}
 
+	for k, v := range r.headers {
+		w.Header().Set(k, v)
+	}
+
 	resp := resp{Type: lxd.Sync, Status: status.String(), StatusCode: status, Metadata: r.metadata}
 	return WriteJson(w, resp)
 }
@@ -103,10 +136,15 @@ func (r *syncResponse) Render(w http.ResponseWriter) error {
  * responses.
  */
 func SyncResponse(success bool, metadata interface{}) Response {
-	return &syncResponse{success, metadata}
+	return &syncResponse{success, metadata, nil}
 }
 
-var EmptySyncResponse = &syncResponse{true, make(map[string]interface{})}
+// SyncResponseHeaders is a SyncResponse with extra HTTP headers.
+func SyncResponseHeaders(success bool, metadata interface{}, headers map[string]string) Response {
+	return &syncResponse{success, metadata, headers}
+}
+
+var EmptySyncResponse = &syncResponse{true, make(map[string]interface{}), nil}
 
 type async struct {
 	Type       lxd.ResponseType       `json:"type"`
@@ -124,6 +162,9 @@ type asyncResponse struct {
 	resources map[string][]string
 	metadata  shared.Jmap
 	done      chan shared.OperationResult
+
+	/* Called with the operation's id before it's started, if set */
+	created func(op string)
 }
 
 func (r *asyncResponse) Render(w http.ResponseWriter) error {
@@ -133,6 +174,10 @@ func (r *asyncResponse) Render(w http.ResponseWriter) error {
 		return err
 	}
 
+	if r.created != nil {
+		r.created(op)
+	}
+
 	err = StartOperation(op)
 	if err != nil {
 		return err
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSeccompPolicyDefault(t *testing.T) {
+	c := &lxdContainer{name: "foo", config: map[string]string{}}
+	policy, err := getSeccompPolicy(c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if policy != SECCOMP_HEADER+"blacklist\n"+DEFAULT_SECCOMP_POLICY {
+		t.Errorf("Bad default policy: %s", policy)
+	}
+}
+
+func TestSeccompPolicyBlacklist(t *testing.T) {
+	c := &lxdContainer{name: "foo", config: map[string]string{"security.syscalls.blacklist": "mount, umount2"}}
+	policy, err := getSeccompPolicy(c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.HasPrefix(policy, SECCOMP_HEADER+"blacklist\n"+DEFAULT_SECCOMP_POLICY) {
+		t.Errorf("Blacklist doesn't extend the default policy: %s", policy)
+	}
+
+	if !strings.HasSuffix(policy, "mount errno 1\numount2 errno 1\n") {
+		t.Errorf("Blacklisted syscalls are missing: %s", policy)
+	}
+}
+
+func TestSeccompPolicyWhitelist(t *testing.T) {
+	c := &lxdContainer{name: "foo", config: map[string]string{"security.syscalls.whitelist": "read,write,exit"}}
+	policy, err := getSeccompPolicy(c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if policy != "2\nwhitelist\n[all]\nread\nwrite\nexit\n" {
+		t.Errorf("Bad whitelist policy: %s", policy)
+	}
+}
+
+func TestSeccompPolicyExclusive(t *testing.T) {
+	c := &lxdContainer{name: "foo", config: map[string]string{
+		"security.syscalls.whitelist": "read",
+		"security.syscalls.blacklist": "mount",
+	}}
+
+	policy, err := getSeccompPolicy(c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if policy != "2\nwhitelist\n[all]\nread\n" {
+		t.Errorf("The whitelist doesn't win over the blacklist: %s", policy)
+	}
+}
+
+func TestSeccompPolicyRaw(t *testing.T) {
+	raw := "2\nblacklist\n[all]\nmount errno 1"
+	c := &lxdContainer{name: "foo", config: map[string]string{
+		"raw.seccomp":                 raw,
+		"security.syscalls.blacklist": "umount2",
+	}}
+	policy, err := getSeccompPolicy(c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if policy != raw+"\n" {
+		t.Errorf("raw.seccomp doesn't replace the policy: %s", policy)
+	}
+}
+
+func TestSeccompInvalidSyscall(t *testing.T) {
+	if err := configValidSyscallList("read,../etc"); err == nil {
+		t.Error("Invalid syscall name accepted")
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 	"gopkg.in/lxc/go-lxc.v2"
@@ -23,6 +25,28 @@ type ContainerStatus struct {
 	StateCode lxc.State `json:"status_code"`
 	Init      int       `json:"init"`
 	Ips       []Ip      `json:"ips"`
+
+	/* Only filled in for running containers, by /1.0/containers/<name>/state */
+	Metrics *ContainerMetrics `json:"metrics,omitempty"`
+}
+
+type ContainerNetworkCounters struct {
+	BytesReceived   int64 `json:"bytes_received"`
+	BytesSent       int64 `json:"bytes_sent"`
+	PacketsReceived int64 `json:"packets_received"`
+	PacketsSent     int64 `json:"packets_sent"`
+}
+
+// ContainerMetrics is the resource usage of a running container. Sizes
+// are in bytes and the CPU time in nanoseconds.
+type ContainerMetrics struct {
+	CPUTime    int64                               `json:"cpu_time"`
+	Memory     int64                               `json:"memory"`
+	MemoryPeak int64                               `json:"memory_peak"`
+	Swap       int64                               `json:"swap"`
+	Disk       int64                               `json:"disk"`
+	Processes  int64                               `json:"processes"`
+	Network    map[string]ContainerNetworkCounters `json:"network"`
 }
 
 func getIps(c *lxc.Container) []Ip {
@@ -58,6 +82,32 @@ func NewStatus(c *lxc.Container, state lxc.State) ContainerStatus {
 	return status
 }
 
+// ContainerProcess is a process running in a container. Pids are those in
+// the container's pid namespace, unless stated otherwise, and the CPU time
+// is in nanoseconds.
+type ContainerProcess struct {
+	Pid       int      `json:"pid"`
+	HostPid   int      `json:"host_pid"`
+	ParentPid int      `json:"parent_pid"`
+	Uid       int      `json:"uid"`
+	User      string   `json:"user"`
+	Command   []string `json:"command"`
+	CPUTime   int64    `json:"cpu_time"`
+	Memory    int64    `json:"memory"`
+}
+
+// ContainerFileEntry describes a file of a container, as listed by the file
+// API. Uid and gid are those in the container, -1 if they aren't mapped.
+type ContainerFileEntry struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Mode   uint32 `json:"mode"`
+	Uid    int    `json:"uid"`
+	Gid    int    `json:"gid"`
+	Size   int64  `json:"size"`
+	Target string `json:"target,omitempty"`
+}
+
 type Device map[string]string
 type Devices map[string]Device
 
@@ -69,6 +119,7 @@ type ContainerState struct {
 	Status    ContainerStatus   `json:"status"`
 	Devices   Devices           `json:"devices"`
 	Ephemeral bool              `json:"ephemeral"`
+	Stateful  bool              `json:"stateful"`
 }
 
 func (c *ContainerState) State() lxc.State {
@@ -85,6 +136,13 @@ const (
 	Unfreeze ContainerAction = "unfreeze"
 )
 
+/*
+ * MigrationUnreachable starts the error of a migration sink which couldn't
+ * connect to the source at all. Nothing was transferred then, so a client
+ * can have the source push the container instead.
+ */
+const MigrationUnreachable = "Couldn't connect to the migration source"
+
 type ProfileConfig struct {
 	Name    string            `json:"name"`
 	Config  map[string]string `json:"config"`
@@ -108,6 +166,34 @@ func ValidDeviceType(t string) bool {
 	}
 }
 
+/*
+ * ParseDiskLimit parses the limits.read or limits.write of a disk, either a
+ * rate in bytes ("10MB") or a number of operations per second ("100iops"),
+ * into the bytes and the operations per second. An empty limit is no
+ * limit.
+ */
+func ParseDiskLimit(limit string) (int64, int64, error) {
+	if limit == "" {
+		return 0, 0, nil
+	}
+
+	if strings.HasSuffix(limit, "iops") {
+		iops, err := strconv.ParseInt(strings.TrimSuffix(limit, "iops"), 10, 64)
+		if err != nil || iops <= 0 {
+			return 0, 0, fmt.Errorf("Invalid disk limit: %s", limit)
+		}
+
+		return 0, iops, nil
+	}
+
+	bps, err := ParseByteSizeString(limit)
+	if err != nil || bps <= 0 {
+		return 0, 0, fmt.Errorf("Invalid disk limit: %s", limit)
+	}
+
+	return bps, 0, nil
+}
+
 func ValidDeviceConfig(t, k, v string) bool {
 	if k == "type" {
 		return false
@@ -157,11 +243,26 @@ func ValidDeviceConfig(t, k, v string) bool {
 			return true
 		case "mtu":
 			return true
+		case "limits.ingress":
+			return true
+		case "limits.egress":
+			return true
+		case "host_name":
+			return true
+		case "macvlan.mode":
+			switch v {
+			case "private", "vepa", "bridge", "passthru":
+				return true
+			default:
+				return false
+			}
 		case "nictype":
-			if v != "bridged" && v != "" {
+			switch v {
+			case "", "bridged", "macvlan", "physical", "p2p":
+				return true
+			default:
 				return false
 			}
-			return true
 		default:
 			return false
 		}
@@ -173,6 +274,20 @@ func ValidDeviceConfig(t, k, v string) bool {
 			return true
 		case "readonly":
 			return true
+		case "optional":
+			return true
+		case "recursive":
+			return true
+		case "propagation":
+			switch v {
+			case "private", "shared", "slave", "unbindable", "rprivate", "rshared", "rslave", "runbindable":
+				return true
+			default:
+				return false
+			}
+		case "limits.read", "limits.write":
+			_, _, err := ParseDiskLimit(v)
+			return err == nil
 		default:
 			return false
 		}
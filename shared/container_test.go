@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"testing"
+)
+
+func TestParseDiskLimit(t *testing.T) {
+	bps, iops, err := ParseDiskLimit("10MB")
+	if err != nil || bps != 10*1024*1024 || iops != 0 {
+		t.Errorf("Bad parse of 10MB: %d %d %v", bps, iops, err)
+	}
+
+	bps, iops, err = ParseDiskLimit("100iops")
+	if err != nil || bps != 0 || iops != 100 {
+		t.Errorf("Bad parse of 100iops: %d %d %v", bps, iops, err)
+	}
+
+	if _, _, err := ParseDiskLimit(""); err != nil {
+		t.Errorf("An empty limit was rejected: %s", err)
+	}
+
+	for _, limit := range []string{"banana", "0", "-1MB", "iops", "0iops"} {
+		if _, _, err := ParseDiskLimit(limit); err == nil {
+			t.Errorf("%q was accepted", limit)
+		}
+	}
+}
+
+func TestValidDeviceConfigDiskLimits(t *testing.T) {
+	if !ValidDeviceConfig("disk", "limits.read", "20iops") {
+		t.Error("A valid limit was rejected")
+	}
+
+	if ValidDeviceConfig("disk", "limits.write", "banana") {
+		t.Error("An invalid limit was accepted")
+	}
+}
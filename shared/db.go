@@ -10,6 +10,7 @@ import (
 	"database/sql"
 	"fmt"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
@@ -25,6 +26,44 @@ func PrintStack() {
 	Debugf("%s", buf)
 }
 
+// DbQueryStats is how many queries of a kind were run and how long they
+// took in total, retries included.
+type DbQueryStats struct {
+	Count    int64
+	Duration time.Duration
+}
+
+var dbStatsLock sync.Mutex
+var dbStats = map[string]*DbQueryStats{}
+
+func dbRecord(kind string, start time.Time) {
+	dbStatsLock.Lock()
+	defer dbStatsLock.Unlock()
+
+	stats, ok := dbStats[kind]
+	if !ok {
+		stats = &DbQueryStats{}
+		dbStats[kind] = stats
+	}
+
+	stats.Count++
+	stats.Duration += time.Since(start)
+}
+
+// DbStats returns the statistics of the queries run through the helpers
+// below, by kind (begin, commit, exec, query, query_row or query_scan).
+func DbStats() map[string]DbQueryStats {
+	dbStatsLock.Lock()
+	defer dbStatsLock.Unlock()
+
+	result := map[string]DbQueryStats{}
+	for kind, stats := range dbStats {
+		result[kind] = *stats
+	}
+
+	return result
+}
+
 func IsDbLockedError(err error) bool {
 	if err == nil {
 		return false
@@ -39,6 +78,8 @@ func IsDbLockedError(err error) bool {
 }
 
 func DbBegin(db *sql.DB) (*sql.Tx, error) {
+	defer dbRecord("begin", time.Now())
+
 	for {
 		tx, err := db.Begin()
 		if err == nil {
@@ -55,6 +96,8 @@ func DbBegin(db *sql.DB) (*sql.Tx, error) {
 }
 
 func TxCommit(tx *sql.Tx) error {
+	defer dbRecord("commit", time.Now())
+
 	for {
 		err := tx.Commit()
 		if err == nil {
@@ -71,6 +114,8 @@ func TxCommit(tx *sql.Tx) error {
 }
 
 func DbQueryRowScan(db *sql.DB, q string, args []interface{}, outargs []interface{}) error {
+	defer dbRecord("query_row", time.Now())
+
 	for {
 		err := db.QueryRow(q, args...).Scan(outargs...)
 		if err == nil {
@@ -87,6 +132,8 @@ func DbQueryRowScan(db *sql.DB, q string, args []interface{}, outargs []interfac
 }
 
 func DbQuery(db *sql.DB, q string, args ...interface{}) (*sql.Rows, error) {
+	defer dbRecord("query", time.Now())
+
 	for {
 		result, err := db.Query(q, args...)
 		if err == nil {
@@ -160,6 +207,8 @@ func doDbQueryScan(db *sql.DB, q string, args []interface{}, outargs []interface
  * of interfaces, containing pointers to the actual output arguments.
  */
 func DbQueryScan(db *sql.DB, q string, inargs []interface{}, outfmt []interface{}) ([][]interface{}, error) {
+	defer dbRecord("query_scan", time.Now())
+
 	for {
 		result, err := doDbQueryScan(db, q, inargs, outfmt)
 		if err == nil {
@@ -176,6 +225,8 @@ func DbQueryScan(db *sql.DB, q string, inargs []interface{}, outfmt []interface{
 }
 
 func DbExec(db *sql.DB, q string, args ...interface{}) (sql.Result, error) {
+	defer dbRecord("exec", time.Now())
+
 	for {
 		result, err := db.Exec(q, args...)
 		if err == nil {
@@ -0,0 +1,22 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDbStats(t *testing.T) {
+	before := DbStats()["test"]
+
+	dbRecord("test", time.Now().Add(-time.Second))
+	dbRecord("test", time.Now())
+
+	after := DbStats()["test"]
+	if after.Count != before.Count+2 {
+		t.Errorf("Expected %d queries, got %d", before.Count+2, after.Count)
+	}
+
+	if after.Duration-before.Duration < time.Second {
+		t.Errorf("Duration wasn't recorded: %s", after.Duration)
+	}
+}
@@ -71,6 +71,18 @@ func (e *idmapEntry) shift_into_ns(id int) (int, error) {
 	return id - e.srcid + e.destid, nil
 }
 
+// String returns the entry in the form parse takes.
+func (e *idmapEntry) String() string {
+	t := "b"
+	if !e.isgid {
+		t = "u"
+	} else if !e.isuid {
+		t = "g"
+	}
+
+	return fmt.Sprintf("%s:%d:%d:%d", t, e.srcid, e.destid, e.maprange)
+}
+
 /* taken from http://blog.golang.org/slices (which is under BSD licence) */
 func extend(slice []idmapEntry, element idmapEntry) []idmapEntry {
 	n := len(slice)
@@ -104,6 +116,61 @@ func (m IdmapSet) Append(s string) (IdmapSet, error) {
 	return m, nil
 }
 
+// Entries returns the ranges of the set, in the form Append takes.
+func (m IdmapSet) Entries() []string {
+	entries := []string{}
+	for _, e := range m.idmap {
+		entries = append(entries, e.String())
+	}
+
+	return entries
+}
+
+// Equals tells whether both sets have the same ranges.
+func (m IdmapSet) Equals(other IdmapSet) bool {
+	if len(m.idmap) != len(other.idmap) {
+		return false
+	}
+
+	for i := range m.idmap {
+		if m.idmap[i] != other.idmap[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+ * Reverse returns the set which maps the ids back: shifting with it undoes
+ * a shift with m.
+ */
+func (m IdmapSet) Reverse() IdmapSet {
+	reverse := IdmapSet{}
+	for _, e := range m.idmap {
+		e.srcid, e.destid = e.destid, e.srcid
+		reverse.idmap = extend(reverse.idmap, e)
+	}
+
+	return reverse
+}
+
+// Ranges returns how many uids and how many gids the set maps.
+func (m IdmapSet) Ranges() (int, int) {
+	uids := 0
+	gids := 0
+	for _, e := range m.idmap {
+		if e.isuid {
+			uids += e.maprange
+		}
+		if e.isgid {
+			gids += e.maprange
+		}
+	}
+
+	return uids, gids
+}
+
 func (m IdmapSet) ShiftIntoNs(uid int, gid int) (int, int) {
 	u := -1
 	g := -1
@@ -0,0 +1,63 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestIdmapSet(t *testing.T, entries ...string) IdmapSet {
+	set := IdmapSet{}
+	for _, entry := range entries {
+		var err error
+		set, err = set.Append(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return set
+}
+
+func TestIdmapSetEntries(t *testing.T) {
+	entries := []string{"u:0:100000:65536", "g:0:200000:65536", "b:65536:300000:10"}
+	set := newTestIdmapSet(t, entries...)
+
+	if strings.Join(set.Entries(), " ") != strings.Join(entries, " ") {
+		t.Errorf("expected %v got %v", entries, set.Entries())
+	}
+
+	if !set.Equals(newTestIdmapSet(t, set.Entries()...)) {
+		t.Error("a set should equal the one built from its entries")
+	}
+
+	if set.Equals(newTestIdmapSet(t, "u:0:100000:65536", "g:0:200000:65536")) {
+		t.Error("sets with different ranges shouldn't be equal")
+	}
+}
+
+func TestIdmapSetReverse(t *testing.T) {
+	set := newTestIdmapSet(t, "u:0:100000:65536", "g:0:200000:65536")
+
+	uid, gid := set.ShiftIntoNs(1000, 1000)
+	if uid != 101000 || gid != 201000 {
+		t.Errorf("expected 101000 201000 got %d %d", uid, gid)
+	}
+
+	uid, gid = set.Reverse().ShiftIntoNs(uid, gid)
+	if uid != 1000 || gid != 1000 {
+		t.Errorf("expected 1000 1000 got %d %d", uid, gid)
+	}
+
+	if !set.Reverse().Reverse().Equals(set) {
+		t.Error("reversing twice should give the set back")
+	}
+}
+
+func TestIdmapSetRanges(t *testing.T) {
+	set := newTestIdmapSet(t, "u:0:100000:65536", "g:0:200000:1000", "b:70000:300000:10")
+
+	uids, gids := set.Ranges()
+	if uids != 65546 || gids != 1010 {
+		t.Errorf("expected 65546 1010 got %d %d", uids, gids)
+	}
+}
@@ -596,6 +596,23 @@ func GetFilesystem(path string) (string, error) {
 	}
 }
 
+// IsBtrfsSubvolume tells whether path is the root of a btrfs subvolume.
+func IsBtrfsSubvolume(path string) bool {
+	fs, err := GetFilesystem(path)
+	if err != nil || fs != "btrfs" {
+		return false
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	/* The root directory of a subvolume is always inode 256 */
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Ino == 256
+}
+
 type BytesReadCloser struct {
 	Buf *bytes.Buffer
 }
@@ -612,3 +629,105 @@ func (r BytesReadCloser) Close() error {
 func IsSnapshot(name string) bool {
 	return strings.Contains(name, "/")
 }
+
+// splitSize splits a human readable quantity such as "10MB" into its numeric
+// value and its unit suffix.
+func splitSize(input string) (float64, string, error) {
+	if input == "" {
+		return 0, "", fmt.Errorf("Empty value")
+	}
+
+	suffixLen := 0
+	for i, c := range input {
+		if (c < '0' || c > '9') && c != '.' {
+			suffixLen = len(input) - i
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(input[0:len(input)-suffixLen], 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("Invalid value: %s", input)
+	}
+
+	return value, input[len(input)-suffixLen:], nil
+}
+
+// ParseByteSizeString parses a human readable size such as "512MB" or
+// "2GB" into a number of bytes. A value without a suffix is taken to be a
+// number of bytes. The single letter suffixes the kernel understands (as in
+// "512M") are accepted too.
+func ParseByteSizeString(input string) (int64, error) {
+	value, suffix, err := splitSize(input)
+	if err != nil {
+		return 0, err
+	}
+
+	multiplicator := int64(1)
+	switch suffix {
+	case "", "B":
+		multiplicator = 1
+	case "kB", "KB", "K":
+		multiplicator = 1024
+	case "MB", "M":
+		multiplicator = 1024 * 1024
+	case "GB", "G":
+		multiplicator = 1024 * 1024 * 1024
+	case "TB", "T":
+		multiplicator = 1024 * 1024 * 1024 * 1024
+	case "PB", "P":
+		multiplicator = 1024 * 1024 * 1024 * 1024 * 1024
+	case "EB", "E":
+		multiplicator = 1024 * 1024 * 1024 * 1024 * 1024 * 1024
+	default:
+		return 0, fmt.Errorf("Invalid size suffix: %s", input)
+	}
+
+	return int64(value * float64(multiplicator)), nil
+}
+
+// GetByteSizeString turns a number of bytes into a human readable size,
+// using the suffixes ParseByteSizeString understands.
+func GetByteSizeString(input int64) string {
+	if input < 1024 {
+		return fmt.Sprintf("%dB", input)
+	}
+
+	value := float64(input)
+	for _, suffix := range []string{"kB", "MB", "GB", "TB", "PB", "EB"} {
+		value = value / 1024
+		if value < 1024 {
+			return fmt.Sprintf("%.2f%s", value, suffix)
+		}
+	}
+
+	return fmt.Sprintf("%.2fEB", value)
+}
+
+// ParseBitSizeString parses a human readable rate such as "100Mbit" into a
+// number of bits. Following tc, the prefixes are powers of 1000. A value
+// without a suffix is taken to be a number of bits.
+func ParseBitSizeString(input string) (int64, error) {
+	value, suffix, err := splitSize(input)
+	if err != nil {
+		return 0, err
+	}
+
+	multiplicator := int64(1)
+	switch suffix {
+	case "", "bit":
+		multiplicator = 1
+	case "kbit":
+		multiplicator = 1000
+	case "Mbit":
+		multiplicator = 1000 * 1000
+	case "Gbit":
+		multiplicator = 1000 * 1000 * 1000
+	case "Tbit":
+		multiplicator = 1000 * 1000 * 1000 * 1000
+	default:
+		return 0, fmt.Errorf("Invalid rate suffix: %s", input)
+	}
+
+	return int64(value * float64(multiplicator)), nil
+}
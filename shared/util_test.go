@@ -51,3 +51,78 @@ func TestCopyFile(t *testing.T) {
 		return
 	}
 }
+
+func TestParseByteSizeString(t *testing.T) {
+	sizes := map[string]int64{
+		"1024":  1024,
+		"512B":  512,
+		"4kB":   4096,
+		"10MB":  10 * 1024 * 1024,
+		"1.5GB": 3 * 512 * 1024 * 1024,
+		"2TB":   2 * 1024 * 1024 * 1024 * 1024,
+		"512M":  512 * 1024 * 1024,
+	}
+
+	for input, expected := range sizes {
+		size, err := ParseByteSizeString(input)
+		if err != nil {
+			t.Errorf("failed parsing %s: %s", input, err)
+			continue
+		}
+
+		if size != expected {
+			t.Errorf("%s parsed as %d, expected %d", input, size, expected)
+		}
+	}
+
+	for _, input := range []string{"", "MB", "10ZB", "ten", "1.2.3GB"} {
+		if _, err := ParseByteSizeString(input); err == nil {
+			t.Errorf("%q should have failed to parse", input)
+		}
+	}
+}
+
+func TestGetByteSizeString(t *testing.T) {
+	sizes := map[int64]string{
+		0:                             "0B",
+		512:                           "512B",
+		4096:                          "4.00kB",
+		3 * 512 * 1024 * 1024:         "1.50GB",
+		2 * 1024 * 1024 * 1024 * 1024: "2.00TB",
+	}
+
+	for input, expected := range sizes {
+		if size := GetByteSizeString(input); size != expected {
+			t.Errorf("%d rendered as %s, expected %s", input, size, expected)
+		}
+	}
+}
+
+func TestParseBitSizeString(t *testing.T) {
+	rates := map[string]int64{
+		"1000":    1000,
+		"64kbit":  64000,
+		"100Mbit": 100000000,
+		"2.5Gbit": 2500000000,
+		"1Tbit":   1000000000000,
+		"1200bit": 1200,
+	}
+
+	for input, expected := range rates {
+		rate, err := ParseBitSizeString(input)
+		if err != nil {
+			t.Errorf("failed parsing %s: %s", input, err)
+			continue
+		}
+
+		if rate != expected {
+			t.Errorf("%s parsed as %d, expected %d", input, rate, expected)
+		}
+	}
+
+	for _, input := range []string{"", "Mbit", "10MB", "fast"} {
+		if _, err := ParseBitSizeString(input); err == nil {
+			t.Errorf("%q should have failed to parse", input)
+		}
+	}
+}
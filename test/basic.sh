@@ -34,8 +34,15 @@ test_basic_usage() {
   lxc init testimage foo
   lxc list | grep foo | grep STOPPED
 
-  # Test container rename
+  # Test container rename, which takes the snapshots along
+  lxc snapshot foo snap0
+  lxc config set foo user.renamed true
   lxc move foo bar
+  lxc list | grep -v foo | grep bar
+  [ "$(lxc config get bar user.renamed)" = "user.renamed: true" ]
+  [ -d "${LXD_DIR}/lxc/bar/snapshots/snap0" ]
+  [ ! -d "${LXD_DIR}/lxc/foo" ]
+  my_curl $BASEURL/1.0/containers/bar/snapshots | grep "bar/snapshots/snap0"
 
   # Test container copy
   lxc copy bar foo
@@ -96,6 +103,22 @@ test_basic_usage() {
   lxc exec foo /bin/cat /root/in1 | grep abc
   lxc exec foo -- /bin/rm -f root/in1
 
+  # test recursive file transfer, directories, symlinks and deletion
+  mkdir -p ${LXD_DIR}/tree/sub
+  echo abc > ${LXD_DIR}/tree/sub/in
+  ln -s sub/in ${LXD_DIR}/tree/link
+  lxc file push -r ${LXD_DIR}/tree foo/root/
+  lxc exec foo /bin/cat /root/tree/sub/in | grep abc
+  [ "$(lxc exec foo -- readlink /root/tree/link)" = "sub/in" ]
+
+  lxc file pull -r foo/root/tree ${LXD_DIR}/pulled
+  grep abc ${LXD_DIR}/pulled/sub/in
+  [ "$(readlink ${LXD_DIR}/pulled/link)" = "sub/in" ]
+  rm -rf ${LXD_DIR}/tree ${LXD_DIR}/pulled
+
+  lxc file delete -r foo/root/tree
+  ! lxc exec foo -- test -e /root/tree
+
   echo foo | lxc exec foo tee /tmp/foo
 
   # Detect regressions/hangs in exec